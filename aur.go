@@ -0,0 +1,120 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:18:35
+ * @LastEditTime: 2026-10-19 14:54:43
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/aur.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	AUR_RPC_INFO   string = "https://aur.archlinux.org/rpc/v5/info"
+	AUR_RPC_SEARCH string = "https://aur.archlinux.org/rpc/v5/search/"
+)
+
+const AUR_RPC_MAX_ARGS int = 100
+
+type AURInfo struct {
+	Name          string   `json:"Name"`
+	PackageBase   string   `json:"PackageBase"`
+	Version       string   `json:"Version"`
+	Maintainer    string   `json:"Maintainer"`
+	CoMaintainers []string `json:"CoMaintainers"`
+	OutOfDate     int64    `json:"OutOfDate"`
+	LastModified  int64    `json:"LastModified"`
+}
+
+// Packages without a custom PKGBUILD are fetched from AUR.
+func IsAURPkg(pkg *Package) bool {
+	return strings.HasPrefix(pkg.PKGBUILD, AUR_URL_BASE)
+}
+
+func AURPkgbase(pkg *Package) string {
+	return strings.TrimPrefix(pkg.PKGBUILD, AUR_URL_BASE)
+}
+
+// Query AUR RPC for the packages, results are indexed by both pkgname and
+// pkgbase. Packages which do not exist (any more) are not in the result.
+func QueryAURInfo(names []string) (map[string]AURInfo, error) {
+	res := make(map[string]AURInfo)
+	for start := 0; start < len(names); start += AUR_RPC_MAX_ARGS {
+		chunk := names[start:min(start+AUR_RPC_MAX_ARGS, len(names))]
+		err := queryAURInfo(chunk, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func queryAURInfo(names []string, res map[string]AURInfo) error {
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("arg[]", name)
+	}
+	resp, err := http.Get(AUR_RPC_INFO + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("AUR RPC returned status " + strconv.Itoa(resp.StatusCode))
+	}
+	var body struct {
+		Type    string    `json:"type"`
+		Error   string    `json:"error"`
+		Results []AURInfo `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return err
+	}
+	if body.Type == "error" {
+		return errors.New("AUR RPC error: " + body.Error)
+	}
+	for _, info := range body.Results {
+		res[info.Name] = info
+		if _, ok := res[info.PackageBase]; !ok {
+			res[info.PackageBase] = info
+		}
+	}
+	return nil
+}
+
+// Find a package of the pkgbase by searching pkgnames, for pkgbases which
+// are not a pkgname themselves.
+func SearchAURPkgbase(pkgbase string) (AURInfo, bool, error) {
+	resp, err := http.Get(AUR_RPC_SEARCH + url.PathEscape(pkgbase) + "?by=name")
+	if err != nil {
+		return AURInfo{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return AURInfo{}, false, errors.New("AUR RPC returned status " + strconv.Itoa(resp.StatusCode))
+	}
+	var body struct {
+		Results []AURInfo `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return AURInfo{}, false, err
+	}
+	for _, info := range body.Results {
+		if info.PackageBase == pkgbase {
+			return info, true, nil
+		}
+	}
+	return AURInfo{}, false, nil
+}
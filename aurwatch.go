@@ -0,0 +1,162 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:21:07
+ * @LastEditTime: 2026-10-19 15:04:59
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/aurwatch.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const DIR_AUR string = "aur"
+
+const SUFFIX_FROZEN string = ".frozen"
+
+const EVENT_AUR string = "aur"
+
+// What we knew about the package on AUR at the last check.
+type AURState struct {
+	Maintainer   string    `json:"maintainer"`
+	OutOfDate    int64     `json:"out_of_date"`
+	LastModified int64     `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+	Checked      time.Time `json:"checked"`
+}
+
+func AURStateDir() string {
+	return path.Join(Conf.WorkingDir, DIR_AUR)
+}
+
+func PkgAURStateFile(pkgName string) string {
+	return path.Join(AURStateDir(), pkgName+".json")
+}
+
+func PkgFrozenFile(pkgName string) string {
+	return path.Join(AURStateDir(), pkgName+SUFFIX_FROZEN)
+}
+
+func LoadAURState(pkgName string) (AURState, bool) {
+	var state AURState
+	content, err := os.ReadFile(PkgAURStateFile(pkgName))
+	if err != nil || json.Unmarshal(content, &state) != nil {
+		return state, false
+	}
+	return state, true
+}
+
+func saveAURState(pkgName string, state AURState) error {
+	content, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(PkgAURStateFile(pkgName), content, 0644)
+}
+
+// Why builds of the package are frozen, empty if they are not.
+func FrozenReason(pkgName string) string {
+	content, err := os.ReadFile(PkgFrozenFile(pkgName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func Freeze(pkgName string, reason string) {
+	err := os.WriteFile(PkgFrozenFile(pkgName), []byte(reason+"\n"), 0644)
+	if err != nil {
+		LogWarn("can not freeze package " + pkgName + ": " + err.Error())
+		return
+	}
+	LogWarn("builds of package " + pkgName + " are frozen: " + reason)
+}
+
+func Unfreeze(pkgName string) error {
+	err := os.Remove(PkgFrozenFile(pkgName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func aurEvent(pkg *Package, detail string, freeze bool) {
+	LogWarn("AUR: package " + pkg.Name + " " + detail)
+	AppendHistory(&BuildRecord{Time: time.Now(), Package: pkg.Name, Event: EVENT_AUR, Result: RESULT_OK, Detail: detail})
+	if freeze && pkg.FreezeOnMaintainerChange {
+		Freeze(pkg.Name, detail)
+	}
+}
+
+// Compare what AUR says now with the last check, warn about deletion,
+// orphaning, out-of-date flags and maintainer changes.
+func CheckAUR() {
+	pkgbases := make([]string, 0)
+	for i := range Conf.Packages {
+		if IsAURPkg(&Conf.Packages[i]) && Conf.Packages[i].IsPrimary() {
+			pkgbases = append(pkgbases, AURPkgbase(&Conf.Packages[i]))
+		}
+	}
+	if len(pkgbases) == 0 {
+		return
+	}
+	infos, err := QueryAURInfo(pkgbases)
+	if err != nil {
+		LogWarn("can not check AUR metadata: " + err.Error())
+		return
+	}
+	err = os.MkdirAll(AURStateDir(), os.ModePerm)
+	if err != nil {
+		LogWarn("can not create AUR state dir: " + err.Error())
+		return
+	}
+	for i := range Conf.Packages {
+		pkg := &Conf.Packages[i]
+		// Variants share the AUR state of the package.
+		if !IsAURPkg(pkg) || !pkg.IsPrimary() {
+			continue
+		}
+		info, found := infos[AURPkgbase(pkg)]
+		if !found {
+			info, found, err = SearchAURPkgbase(AURPkgbase(pkg))
+			if err != nil {
+				LogWarn("can not check AUR metadata of package " + pkg.Name + ": " + err.Error())
+				continue
+			}
+		}
+		old, known := LoadAURState(pkg.Name)
+		cur := AURState{Maintainer: info.Maintainer, OutOfDate: info.OutOfDate, LastModified: info.LastModified, Deleted: !found, Checked: time.Now()}
+		if !found {
+			cur.Maintainer = old.Maintainer
+			if !old.Deleted {
+				aurEvent(pkg, "was deleted from AUR", true)
+			}
+		} else {
+			switch {
+			case known && old.Deleted:
+				aurEvent(pkg, "is back on AUR, maintained by \""+cur.Maintainer+"\"", true)
+			case known && old.Maintainer != cur.Maintainer && cur.Maintainer == "":
+				aurEvent(pkg, "was orphaned by \""+old.Maintainer+"\"", true)
+			case known && old.Maintainer != cur.Maintainer:
+				aurEvent(pkg, "changed maintainer from \""+old.Maintainer+"\" to \""+cur.Maintainer+"\"", true)
+			case !known && cur.Maintainer == "":
+				aurEvent(pkg, "is orphaned", false)
+			}
+			if cur.OutOfDate != 0 && old.OutOfDate != cur.OutOfDate {
+				aurEvent(pkg, "was flagged out-of-date on "+time.Unix(cur.OutOfDate, 0).Format(time.DateOnly), false)
+			}
+		}
+		err = saveAURState(pkg.Name, cur)
+		if err != nil {
+			LogWarn("can not save AUR metadata of package " + pkg.Name + ": " + err.Error())
+		}
+	}
+}
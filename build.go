@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-07-29 16:22:12
- * @LastEditTime: 2025-08-09 00:38:15
+ * @LastEditTime: 2026-10-19 15:13:34
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /repo-donkey/build.go
@@ -11,11 +11,9 @@
 package main
 
 import (
-	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
@@ -31,51 +29,44 @@ func LogsDir() string {
 }
 
 func PkgBuildingDir(pkg *Package) string {
-	return path.Join(BuildingDir(), pkg.Name)
+	return path.Join(BuildingDir(), pkg.ID())
 }
 
 func PkgLogsDir(pkg *Package) string {
-	return path.Join(LogsDir(), pkg.Name)
-}
-
-func PkgChrootDir(pkg *Package) string {
-	return path.Join(PkgBuildingDir(pkg), DIR_CHROOT)
-}
-
-func PkgRootDir(pkg *Package) string {
-	return path.Join(PkgChrootDir(pkg), DIR_ROOT)
+	return path.Join(LogsDir(), pkg.ID())
 }
 
 func PkgPkgbuild(pkg *Package) string {
 	return path.Join(PkgBuildingDir(pkg), "PKGBUILD")
 }
 
-func initWorkingDirs(limiter chan struct{}) {
+func initWorkingDirs() {
 	LogInfo("init working dirs...")
 	Check(os.MkdirAll(Conf.WorkingDir, os.ModePerm))
 	Check(os.MkdirAll(BuildingDir(), os.ModePerm))
 	Check(os.MkdirAll(LogsDir(), os.ModePerm))
+	Check(os.MkdirAll(ChrootsDir(), os.ModePerm))
 	for _, pkg := range Conf.Packages {
-		limiter <- struct{}{}
-		JobsWg.Add(1)
-		go func() {
-			defer JobsWg.Done()
-			defer func() { <-limiter }()
-			LogInfo("start to init the working dir for package \"" + pkg.Name + "\"")
-			Check(os.MkdirAll(PkgBuildingDir(&pkg), os.ModePerm))
-			Check(os.MkdirAll(PkgLogsDir(&pkg), os.ModePerm))
-			Check(os.MkdirAll(PkgChrootDir(&pkg), os.ModePerm))
-			if !DirExists(PkgRootDir(&pkg)) {
-				Check(SudoRun(Conf.BuildUser, Conf.BuildGroup, path.Join(PkgLogsDir(&pkg), LOG_FILE_MKARCHROOT),
-					BIN_MKARCHROOT, PkgRootDir(&pkg), "base-devel"))
-			}
-			LogInfo("successfully inited working dir for package \"" + pkg.Name + "\"")
-		}()
-	}
-	JobsWg.Wait()
+		Check(os.MkdirAll(PkgBuildingDir(&pkg), os.ModePerm))
+		Check(os.MkdirAll(PkgLogsDir(&pkg), os.ModePerm))
+	}
+	WarnLegacyChroots()
 	LogInfo("all working dirs inited")
 }
 
+// Options of mkarchroot and arch-nspawn to copy the makepkg.conf and
+// pacman.conf of the package into the chroot.
+func ChrootConfArgs(pkg *Package) []string {
+	args := make([]string, 0)
+	if pkg.PacmanConf != "" {
+		args = append(args, "-C", pkg.PacmanConf)
+	}
+	if pkg.MakepkgConf != "" {
+		args = append(args, "-M", pkg.MakepkgConf)
+	}
+	return args
+}
+
 func GetPkgbuild(pkg *Package) ([]byte, error) {
 	if pkg.PKGBUILD == "" {
 		LogError("no PKGBUILD specified for " + pkg.Name)
@@ -99,24 +90,8 @@ func GetPkgbuild(pkg *Package) ([]byte, error) {
 	return pkgbuild, nil
 }
 
-func PreBuildPrepare(pkg *Package) (string, bool, error) {
+func PreBuildPrepare(pkg *Package, rec *BuildRecord) (string, bool, error) {
 	logFile := path.Join(PkgLogsDir(pkg), strconv.Itoa(int(time.Now().Unix()))+".log")
-	if Conf.MakepkgConf != "" {
-		makepkgConf := path.Join(PkgRootDir(pkg), CONF_MAKEPKG)
-		eq, err := EqualFiles(makepkgConf, Conf.MakepkgConf)
-		Check(err)
-		if !eq {
-			CopyAndOverwrite(makepkgConf, Conf.MakepkgConf)
-		}
-	}
-	if Conf.PacmanConf != "" {
-		pacmanConf := path.Join(PkgRootDir(pkg), CONF_PACMAN)
-		eq, err := EqualFiles(pacmanConf, Conf.PacmanConf)
-		Check(err)
-		if !eq {
-			CopyAndOverwrite(pacmanConf, Conf.PacmanConf)
-		}
-	}
 	if DirExists(PkgPkgbuild(pkg)) {
 		LogError("PKGBUILD of package " + pkg.Name + " exists but is a dir")
 	}
@@ -125,6 +100,10 @@ func PreBuildPrepare(pkg *Package) (string, bool, error) {
 		LogWarn("can not build package " + pkg.Name + " since can not get PKGBUILD, error is: " + err.Error())
 		return logFile, false, err
 	}
+	wantedPkgbuild, err = ReviewPkgbuild(pkg, wantedPkgbuild, rec)
+	if err != nil {
+		return logFile, false, err
+	}
 	if !FileExists(PkgPkgbuild(pkg)) || !PanicOnErr(FileContentIs(PkgPkgbuild(pkg), wantedPkgbuild)) {
 		file, err := os.Create(PkgPkgbuild(pkg))
 		if err != nil {
@@ -142,111 +121,95 @@ func PreBuildPrepare(pkg *Package) (string, bool, error) {
 	} else {
 		return logFile, false, nil
 	}
-	err = SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, BIN_ARCH_NSPAWN, PkgRootDir(pkg), BIN_PACMAN, "-Syu")
-	if err != nil {
-		return logFile, false, err
-	}
 	return logFile, true, nil
 }
 
-func BuildPkg(pkg *Package, logFile string) error {
+// Env vars given to hooks, instead of splicing values into the hook.
+func HookEnv(pkg *Package) []string {
+	return []string{
+		ENV_PKG_NAME + "=" + pkg.Name,
+		ENV_VARIANT + "=" + pkg.Variant,
+		ENV_BUILDING_DIR + "=" + PkgBuildingDir(pkg),
+	}
+}
+
+// Hooks are provided by the user, so they are the only thing run by a shell.
+func runHook(pkg *Package, hook string, logFile string) error {
+	cmd := ExtCmd{Argv: []string{BIN_BASH, "-c", hook}, Env: HookEnv(pkg), User: Conf.BuildUser, Group: Conf.BuildGroup}
+	return cmd.Run(logFile)
+}
+
+// Arguments makechrootpkg passes to makepkg, makepkg puts NAME=value ones
+// into the build environment.
+func MakepkgArgs(pkg *Package) []string {
+	res := make([]string, 0)
+	if pkg.NoCheck {
+		res = append(res, "--nocheck")
+	}
+	if pkg.BuildProxy != "" {
+		for _, name := range PROXY_VARS {
+			res = append(res, name+"="+pkg.BuildProxy)
+		}
+	}
+	return append(res, pkg.Env...)
+}
+
+// Build in a snapshot of the master chroot, or in the working copy of the
+// worker, which makechrootpkg syncs from the master first.
+func BuildPkg(pkg *Package, worker int, logFile string) error {
 	if pkg.PreBuild != "" {
-		toPreBuildRun := make([]string, 0)
-		toPreBuildRun = append(toPreBuildRun, BIN_BASH)
-		toPreBuildRun = append(toPreBuildRun, "-c")
-		toPreBuildRun = append(toPreBuildRun, pkg.PreBuild)
-		err := SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, toPreBuildRun[0], toPreBuildRun[1:]...)
+		err := runHook(pkg, pkg.PreBuild, logFile)
 		if err != nil {
 			return err
 		}
 	}
-	toRun := make([]string, 0)
-	toRun = append(toRun, BIN_BASH)
-	toRun = append(toRun, "-c")
-	cmdStr := fmt.Sprintf("cd %s;", PkgBuildingDir(pkg)) + " "
-	cmdStr += BIN_SUDO + " "
-	cmdStr += "-u " + Conf.BuildUser + " "
-	cmdStr += "-g " + Conf.BuildGroup + " "
-	cmdStr += BIN_MAKECHROOTPKG + " "
-	cmdStr += "-c -r" + " "
-	cmdStr += DIR_CHROOT
-	if pkg.BuildProxy != "" {
-		cmdStr += fmt.Sprintf(" -- ALL_PROXY=%s HTTP_PROXY=%s HTTPS_PROXY=%s all_proxy=%s http_proxy=%s https_proxy=%s",
-			pkg.BuildProxy, pkg.BuildProxy, pkg.BuildProxy, pkg.BuildProxy, pkg.BuildProxy, pkg.BuildProxy) + " "
-	}
-	toRun = append(toRun, cmdStr)
-	cmd := exec.Command(toRun[0], toRun[1:]...)
-	err := RunWithLog(cmd, toRun, logFile)
+	// The snapshot or copy is made under root.lock, by NewSnapshot or by
+	// makechrootpkg itself, only overlays keep the master locked.
+	key := ChrootKey(pkg)
+	argv := []string{BIN_MAKECHROOTPKG, "-c", "-r", MasterDir(key), "-l", WorkerCopy(worker)}
+	if SnapshotMode(key) != SNAPSHOT_COPY {
+		snap, err := NewSnapshot(key, worker, logFile)
+		if err != nil {
+			chrootBuildFailed(key, logFile)
+			return err
+		}
+		defer snap.Remove(logFile)
+		// Without -c makechrootpkg builds in the existing copy as it is.
+		argv = []string{BIN_MAKECHROOTPKG, "-r", MasterDir(key), "-l", snap.Name}
+	} else if pkg.ChrootTempCopy {
+		// Snapshots are thrown away anyway, only a plain copy needs -T.
+		argv = append(argv, "-T")
+	}
+	if pkg.ChrootNamcap {
+		argv = append(argv, "-n")
+	}
+	argv = append(append(argv, "--"), MakepkgArgs(pkg)...)
+	cmd := ExtCmd{Argv: argv, Dir: PkgBuildingDir(pkg), User: Conf.BuildUser, Group: Conf.BuildGroup}
+	size := logSize(logFile)
+	err := cmd.Run(logFile)
 	if err != nil {
+		if out := logSince(logFile, size); !strings.Contains(out, MAKEPKG_STARTED) || hasKeyringError(out) {
+			chrootBuildFailed(key, logFile)
+		}
 		return err
 	}
+	resetChrootFailures(key)
 	if pkg.PostBuild != "" {
-		toPostBuildRun := make([]string, 0)
-		toPostBuildRun = append(toPostBuildRun, BIN_BASH)
-		toPostBuildRun = append(toPostBuildRun, "-c")
-		toPostBuildRun = append(toPostBuildRun, pkg.PostBuild)
-		err = SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, toPostBuildRun[0], toPostBuildRun[1:]...)
+		err = runHook(pkg, pkg.PostBuild, logFile)
 	}
 	return err
 }
 
 func PostBuildOps(pkg *Package, logFile string) error {
-	if Conf.PkgSignKey != "" {
-		buildingDir, err := os.ReadDir(PkgBuildingDir(pkg))
-		if err != nil {
-			return err
-		}
-		for _, e := range buildingDir {
-			if e.IsDir() {
-				continue
-			}
-			if strings.HasSuffix(e.Name(), SUFFIX_PKG) {
-				args := make([]string, 0)
-				args = append(args, "--sign", "--detach-sign", "--yes")
-				if Conf.PkgSignKey != SIGN_USE_DEFAULT {
-					args = append(args, "--default-key", Conf.PkgSignKey)
-				}
-				args = append(args, path.Join(PkgBuildingDir(pkg), e.Name()))
-				SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, BIN_GPG, args...)
-			}
-		}
-	}
 	buildingDir, err := os.ReadDir(PkgBuildingDir(pkg))
 	if err != nil {
 		return err
 	}
+	archives := make([]string, 0)
 	for _, e := range buildingDir {
-		if e.IsDir() {
-			continue
-		}
-		if strings.HasSuffix(e.Name(), SUFFIX_PKG) || strings.HasSuffix(e.Name(), SUFFIX_SIG) {
-			err := CopyAndOverwrite(path.Join(path.Dir(Conf.TargetDB), e.Name()), path.Join(PkgBuildingDir(pkg), e.Name()))
-			if err != nil {
-				return err
-			}
-			err = os.Remove(path.Join(PkgBuildingDir(pkg), e.Name()))
-			if err != nil {
-				return err
-			}
-		}
-		if !strings.HasSuffix(e.Name(), SUFFIX_PKG) {
-			continue
-		}
-		toRun := make([]string, 0)
-		toRun = append(toRun, BIN_REPO_ADD, "--remove")
-		switch Conf.PkgSignKey {
-		case "":
-			LogInfo("will not going to check and sign DB since no key specified")
-		case SIGN_USE_DEFAULT:
-			toRun = append(toRun, "--verify", "--sign")
-		default:
-			toRun = append(toRun, "--verify", "--sign", "--key", Conf.PkgSignKey)
-		}
-		toRun = append(toRun, Conf.TargetDB, path.Join(path.Dir(Conf.TargetDB), e.Name()))
-		err := SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, toRun[0], toRun[1:]...)
-		if err != nil {
-			return err
+		if !e.IsDir() && strings.HasSuffix(e.Name(), SUFFIX_PKG) {
+			archives = append(archives, path.Join(PkgBuildingDir(pkg), e.Name()))
 		}
 	}
-	return nil
+	return Publish(pkg, archives)
 }
@@ -0,0 +1,321 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:30:32
+ * @LastEditTime: 2026-10-19 15:20:09
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/chroot.go
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DIR_CHROOTS        string = "chroots"
+	FILE_ROOT_LOCK     string = "root.lock"
+	CHROOT_KEY_DEFAULT string = "default"
+	WORKER_COPY_PREFIX string = "worker"
+	DIR_CACHE          string = "cache"
+)
+
+// Serializes the preparation at the start of rounds and the maintenance.
+var mastersLock sync.Mutex
+
+type cachedChrootKey struct {
+	stamp string
+	key   string
+}
+
+// Chroot keys of the packages by ID, with the stamps of the conf files they
+// were computed from.
+var (
+	chrootKeysLock sync.Mutex
+	chrootKeys     = make(map[string]cachedChrootKey)
+)
+
+func ChrootsDir() string {
+	return path.Join(Conf.WorkingDir, DIR_CHROOTS)
+}
+
+// Packages built with the same pacman.conf, makepkg.conf and extra chroot
+// packages share one master chroot, the key tells which one.
+func ChrootKey(pkg *Package) string {
+	if pkg.PacmanConf == "" && pkg.MakepkgConf == "" && len(pkg.ChrootPackages) == 0 {
+		return CHROOT_KEY_DEFAULT
+	}
+	// The conf files are read and hashed again only when their paths,
+	// mtimes or sizes changed.
+	stamp := confStamp(pkg)
+	chrootKeysLock.Lock()
+	defer chrootKeysLock.Unlock()
+	cached, ok := chrootKeys[pkg.ID()]
+	if ok && cached.stamp == stamp {
+		return cached.key
+	}
+	key := chrootKey(pkg)
+	chrootKeys[pkg.ID()] = cachedChrootKey{stamp: stamp, key: key}
+	return key
+}
+
+func confStamp(pkg *Package) string {
+	stamp := ""
+	for _, conf := range []string{pkg.PacmanConf, pkg.MakepkgConf} {
+		stamp += conf + "\n"
+		if info, err := os.Stat(conf); err == nil {
+			stamp += info.ModTime().Format(time.RFC3339Nano) + " " + strconv.FormatInt(info.Size(), 10)
+		}
+		stamp += "\n"
+	}
+	return stamp
+}
+
+func chrootKey(pkg *Package) string {
+	hash := sha256.New()
+	extras := slices.Clone(pkg.ChrootPackages)
+	slices.Sort(extras)
+	hash.Write([]byte(strings.Join(slices.Compact(extras), ",") + "\n"))
+	// Only the content counts, generated makepkg.confs of different
+	// packages may be the same.
+	for _, conf := range []string{pkg.PacmanConf, pkg.MakepkgConf} {
+		content := []byte("unset")
+		if conf != "" {
+			content, _ = os.ReadFile(conf)
+		}
+		hash.Write([]byte(strconv.Itoa(len(content)) + "\n"))
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// The dir given to makechrootpkg -r, the master is its "root" and the
+// working copies of workers live next to it.
+func MasterDir(key string) string {
+	return path.Join(ChrootsDir(), key)
+}
+
+func MasterRoot(key string) string {
+	return path.Join(MasterDir(key), DIR_ROOT)
+}
+
+// Packages installed in the master, the global ones and the extra ones of
+// the packages using it.
+func MasterPackages(key string) []string {
+	res := append(slices.Clone(Conf.ChrootPackages), masterPkg(key).ChrootPackages...)
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// A package using the master, all of them set it up the same way. Masters
+// no package uses any more fall back to the global settings.
+func masterPkg(key string) *Package {
+	for i := range Conf.Packages {
+		if ChrootKey(&Conf.Packages[i]) == key {
+			return &Conf.Packages[i]
+		}
+	}
+	return &Package{MakepkgConf: Conf.MakepkgConf, PacmanConf: Conf.PacmanConf}
+}
+
+func MasterLogFile(key string) string {
+	return path.Join(LogsDir(), DIR_CHROOTS, key+".log")
+}
+
+// Masters use their own package cache, so cleaning it never touches the
+// cache of the host, which arch-nspawn binds by default.
+func MasterCacheDir(key string) string {
+	return path.Join(MasterDir(key), DIR_CACHE)
+}
+
+// Options of mkarchroot and arch-nspawn for the master chroot.
+func masterArgs(key string) []string {
+	return append(ChrootConfArgs(masterPkg(key)), "-c", MasterCacheDir(key))
+}
+
+func WorkerCopy(worker int) string {
+	return WORKER_COPY_PREFIX + strconv.Itoa(worker)
+}
+
+// Distinct master chroot keys used by the configured packages.
+func MasterKeys() []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for i := range Conf.Packages {
+		key := ChrootKey(&Conf.Packages[i])
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Create the master chroot, or check and upgrade it, running the whole
+// maintenance instead if it is due. A broken master is recreated at once.
+// Caller must hold the chroot lock.
+func PrepareMaster(key string) error {
+	if !DirExists(MasterRoot(key)) {
+		return rebuildMaster(key)
+	}
+	if reason := MasterBroken(key); reason != "" {
+		LogWarn("master chroot \"" + key + "\" is broken, will recreate it: " + reason)
+		return rebuildMaster(key)
+	}
+	if cnt := ChrootFailures(key); cnt >= Conf.ChrootMaxFailures {
+		LogWarn("master chroot \"" + key + "\" failed " + strconv.Itoa(cnt) + " time(s) in a row, will recreate it")
+		return rebuildMaster(key)
+	}
+	err := syncMasterPackages(key)
+	if err != nil {
+		return err
+	}
+	if MaintenanceDue(key) {
+		return MaintainMaster(key)
+	}
+	upgradeMaster(key)
+	return nil
+}
+
+func initMasterDirs(key string) error {
+	err := os.MkdirAll(MasterDir(key), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(MasterCacheDir(key), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path.Dir(MasterLogFile(key)), os.ModePerm)
+}
+
+// Take the chroot lock of the master without waiting.
+func tryLockMaster(key string) (*os.File, error) {
+	err := initMasterDirs(key)
+	if err != nil {
+		return nil, err
+	}
+	return TryLock(ChrootLockFile(key))
+}
+
+// Prepare every master chroot once per round, returns the keys which failed,
+// packages using them will not be built in this round. Busy masters are
+// skipped instead of waited for, builds use them as they are if they exist.
+func PrepareMasters() map[string]bool {
+	failed := make(map[string]bool)
+	if !mastersLock.TryLock() {
+		LogInfo("master chroots are being maintained, will not prepare them in this round")
+		for _, key := range MasterKeys() {
+			if !DirExists(MasterRoot(key)) {
+				failed[key] = true
+			}
+		}
+		return failed
+	}
+	defer mastersLock.Unlock()
+	for _, key := range MasterKeys() {
+		lockFile, err := tryLockMaster(key)
+		if err == ErrLocked {
+			LogInfo("master chroot \"" + key + "\" is busy, will not prepare it in this round")
+			if !DirExists(MasterRoot(key)) {
+				failed[key] = true
+			}
+			continue
+		}
+		if err == nil {
+			err = PrepareMaster(key)
+			Unlock(lockFile)
+		}
+		if err != nil {
+			LogWarn("can not prepare master chroot \"" + key + "\", see " + MasterLogFile(key) + ": " + err.Error())
+			failed[key] = true
+		}
+	}
+	return failed
+}
+
+func legacyChrootDirs() []string {
+	res := make([]string, 0)
+	entries, err := os.ReadDir(BuildingDir())
+	if err != nil {
+		return res
+	}
+	for _, e := range entries {
+		dir := path.Join(BuildingDir(), e.Name(), DIR_CHROOT)
+		if e.IsDir() && DirExists(dir) {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+func WarnLegacyChroots() {
+	if dirs := legacyChrootDirs(); len(dirs) > 0 {
+		LogWarn(strconv.Itoa(len(dirs)) + " old per-package chroot(s) found in " + BuildingDir() + ", they are no longer used, run \"chroot migrate\" to remove them")
+	}
+}
+
+// Remove the per-package chroots used by older versions, the building dir of
+// the package is locked meanwhile.
+func MigrateChroots() {
+	for _, dir := range legacyChrootDirs() {
+		lockFile, err := TryLock(path.Join(path.Dir(dir), FILE_LOCK))
+		if err != nil {
+			LogWarn("will not remove " + dir + ": " + err.Error())
+			continue
+		}
+		err = os.RemoveAll(dir)
+		Unlock(lockFile)
+		if err != nil {
+			LogWarn("can not remove " + dir + ", please remove it as root: " + err.Error())
+			continue
+		}
+		LogInfo("removed old chroot " + dir)
+	}
+}
+
+// Keys of the master chroots to rebuild, of one package or of all.
+func rebuildTargets(arg string) []string {
+	if arg == "--all" {
+		return MasterKeys()
+	}
+	return []string{ChrootKey(PkgByID(arg))}
+}
+
+// Remove masters no configured package uses any more, for example after a
+// config change gave them a new key.
+func PruneMasters() {
+	entries, err := os.ReadDir(ChrootsDir())
+	if err != nil {
+		return
+	}
+	used := MasterKeys()
+	for _, e := range entries {
+		if !e.IsDir() || slices.Contains(used, e.Name()) {
+			continue
+		}
+		lockFile, err := Lock(ChrootLockFile(e.Name()))
+		if err != nil {
+			LogWarn("will not remove unused master chroot \"" + e.Name() + "\": " + err.Error())
+			continue
+		}
+		cleanMasterSnapshots(e.Name())
+		err = os.RemoveAll(MasterDir(e.Name()))
+		Unlock(lockFile)
+		if err != nil {
+			LogWarn("can not remove unused master chroot \"" + e.Name() + "\", please remove it as root: " + err.Error())
+			continue
+		}
+		LogInfo("removed unused master chroot \"" + e.Name() + "\"")
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 16:02:11
+ * @LastEditTime: 2026-10-19 15:20:09
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/chroot_test.go
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestChrootKeyFollowsConf(t *testing.T) {
+	conf := path.Join(t.TempDir(), "pacman.conf")
+	if err := os.WriteFile(conf, []byte("[options]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := &Package{Name: "chroot-key-test", PacmanConf: conf}
+	first := ChrootKey(pkg)
+	if first == CHROOT_KEY_DEFAULT || ChrootKey(pkg) != first {
+		t.Fatalf("unstable key %q", first)
+	}
+	if err := os.WriteFile(conf, []byte("[options]\nParallelDownloads = 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(conf, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if ChrootKey(pkg) == first {
+		t.Fatal("key kept after the conf changed")
+	}
+	if ChrootKey(pkg) != chrootKey(pkg) {
+		t.Fatal("cached key differs from a fresh one")
+	}
+}
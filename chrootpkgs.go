@@ -0,0 +1,80 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:35:11
+ * @LastEditTime: 2026-10-19 15:02:16
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/chrootpkgs.go
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	FILE_PACKAGES  string = "packages"
+	PKG_BASE_DEVEL string = "base-devel"
+)
+
+func packagesFile(key string) string {
+	return path.Join(MasterDir(key), FILE_PACKAGES)
+}
+
+// Packages the master was set up with, masters created before this was
+// recorded only have base-devel.
+func InstalledPackages(key string) []string {
+	data, err := os.ReadFile(packagesFile(key))
+	if err != nil {
+		return []string{PKG_BASE_DEVEL}
+	}
+	return strings.Fields(string(data))
+}
+
+func saveInstalledPackages(key string, pkgs []string) {
+	err := os.WriteFile(packagesFile(key), []byte(strings.Join(pkgs, "\n")+"\n"), 0644)
+	if err != nil {
+		LogWarn("can not record packages of master chroot \"" + key + "\": " + err.Error())
+	}
+}
+
+// Install packages added to the configured set, a master with packages
+// removed from the set is recreated, since removing them cleanly is not
+// always possible.
+func syncMasterPackages(key string) error {
+	installed := InstalledPackages(key)
+	wanted := MasterPackages(key)
+	for _, name := range installed {
+		if !slices.Contains(wanted, name) {
+			LogWarn("package " + name + " was removed from master chroot \"" + key + "\", will recreate it")
+			return rebuildMaster(key)
+		}
+	}
+	added := make([]string, 0)
+	for _, name := range wanted {
+		if !slices.Contains(installed, name) {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	LogInfo("installing " + strings.Join(added, ", ") + " into master chroot \"" + key + "\"")
+	lockFile, err := Lock(path.Join(MasterDir(key), FILE_ROOT_LOCK))
+	if err != nil {
+		return err
+	}
+	defer Unlock(lockFile)
+	args := append(append(masterArgs(key), MasterRoot(key), BIN_PACMAN, "-Syu", "--noconfirm", "--needed"), added...)
+	err = SudoRun(Conf.BuildUser, Conf.BuildGroup, MasterLogFile(key), BIN_ARCH_NSPAWN, args...)
+	if err != nil {
+		return err
+	}
+	saveInstalledPackages(key, wanted)
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:17:53
+ * @LastEditTime: 2026-10-19 15:04:59
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/cli.go
+ */
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Command struct {
+	Usage string
+	Run   func(args []string)
+}
+
+var Commands map[string]Command
+
+func init() {
+	Commands = map[string]Command{
+		"status":       {"status", cmdStatus},
+		"approve":      {"approve <pkg>", cmdApprove},
+		"reject":       {"reject <pkg>", cmdReject},
+		"history":      {"history <pkg[@variant]>", cmdHistory},
+		"unfreeze":     {"unfreeze <pkg>", cmdUnfreeze},
+		"keys":         {"keys", cmdKeys},
+		"key-approve":  {"key-approve <fingerprint>", cmdKeyApprove},
+		"key-reject":   {"key-reject <fingerprint>", cmdKeyReject},
+		"resign":       {"resign", cmdResign},
+		"promote":      {"promote <pkg[@variant]>", cmdPromote},
+		"hold":         {"hold <pkg[@variant]> [reason]", cmdHold},
+		"unhold":       {"unhold <pkg[@variant]>", cmdUnhold},
+		"setup":        {"setup --print-sudoers", cmdSetup},
+		CMD_PRIVILEGED: {CMD_PRIVILEGED + " <tool> [args] (run by sudo)", RunPrivileged},
+		"chroot":       {"chroot migrate | chroot prune | chroot rebuild <pkg[@variant]|--all>", cmdChroot},
+	}
+}
+
+func usage() string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	lines := []string{"usage: repo-donkey <config> [command]", "commands:"}
+	for _, name := range names {
+		lines = append(lines, "  "+Commands[name].Usage)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func RunCommand(args []string) {
+	cmd, ok := Commands[args[0]]
+	if !ok {
+		LogError("unknown command \"" + args[0] + "\"\n" + usage())
+	}
+	cmd.Run(args[1:])
+}
+
+// Exactly one configured package name is expected.
+func pkgArg(args []string) string {
+	if len(args) != 1 {
+		LogError("exactly one package name expected\n" + usage())
+	}
+	if PkgByName(args[0]) == nil {
+		LogError("package \"" + args[0] + "\" not found in config")
+	}
+	return args[0]
+}
+
+// Exactly one package name, or name@variant for a variant of it.
+func pkgIDArg(args []string) string {
+	if len(args) != 1 {
+		LogError("exactly one package expected\n" + usage())
+	}
+	if PkgByID(args[0]) == nil {
+		LogError("package \"" + args[0] + "\" not found in config")
+	}
+	return args[0]
+}
+
+func cmdStatus(args []string) {
+	Check(Queue.Load())
+	fmt.Println("Jobs in queue: " + strconv.Itoa(len(Queue.Jobs)))
+	for _, job := range Queue.Jobs {
+		fmt.Println("  #" + strconv.FormatInt(job.ID, 10) + " " + job.Package + " " + job.State)
+	}
+	for _, pkg := range Conf.Packages {
+		if reason := FrozenReason(pkg.Name); reason != "" && pkg.IsPrimary() {
+			fmt.Println("Frozen: " + pkg.Name + " (" + reason + ")")
+		}
+		if reason := HoldReason(pkg.ID()); reason != "" {
+			fmt.Println("Held: " + pkg.ID() + " (" + reason + ")")
+		}
+	}
+	for _, key := range MasterKeys() {
+		state := LoadMaintenance(key)
+		line := "Master chroot " + key + ": "
+		switch {
+		case state.Time.IsZero():
+			line += "never maintained"
+		case state.OK:
+			line += "maintained at " + state.Time.Format(time.DateTime)
+		default:
+			line += "maintenance failed at " + state.Time.Format(time.DateTime) + " (" + state.Detail + ")"
+		}
+		if cnt := ChrootFailures(key); cnt > 0 {
+			line += ", " + strconv.Itoa(cnt) + " failure(s) in a row"
+		}
+		fmt.Println(line)
+	}
+	pending := PendingReviews()
+	fmt.Println("PKGBUILDs awaiting review: " + strconv.Itoa(len(pending)))
+	for _, name := range pending {
+		diff, err := PendingDiff(name)
+		Check(err)
+		fmt.Println("== " + name + " ==")
+		for _, f := range PendingFindings(name) {
+			fmt.Println("!! " + f.String())
+		}
+		fmt.Print(diff)
+	}
+}
+
+func cmdApprove(args []string) {
+	name := pkgArg(args)
+	Check(ApproveRevision(name))
+	fmt.Println("approved the pending PKGBUILD revision of package " + name)
+}
+
+func cmdReject(args []string) {
+	name := pkgArg(args)
+	Check(RejectRevision(name))
+	fmt.Println("rejected the pending PKGBUILD revision of package " + name + ", the approved revision will be built")
+}
+
+func cmdHistory(args []string) {
+	name := pkgIDArg(args)
+	records, err := ReadHistory(name)
+	Check(err)
+	for _, rec := range records {
+		line := rec.Time.Format(time.DateTime) + " " + rec.Event + " " + rec.Result
+		if rec.Detail != "" {
+			line += ": " + rec.Detail
+		}
+		fmt.Println(line)
+		for _, f := range rec.Findings {
+			fmt.Println("  !! " + f.String())
+		}
+	}
+}
+
+func cmdUnfreeze(args []string) {
+	name := pkgArg(args)
+	Check(Unfreeze(name))
+	fmt.Println("builds of package " + name + " are no longer frozen")
+}
+
+func keyArg(args []string) string {
+	if len(args) != 1 {
+		LogError("exactly one key fingerprint expected\n" + usage())
+	}
+	return args[0]
+}
+
+func cmdKeys(args []string) {
+	fmt.Println("Trusted PGP keys:")
+	for _, fpr := range ListKeys(DIR_KEYS_TRUSTED) {
+		fmt.Println("  " + fpr)
+	}
+	fmt.Println("PGP keys awaiting approval:")
+	for _, fpr := range ListKeys(DIR_KEYS_PENDING) {
+		fmt.Println("  " + fpr + " (" + pendingKeyFile(fpr) + ")")
+	}
+}
+
+func cmdKeyApprove(args []string) {
+	fpr := keyArg(args)
+	Check(ApproveKey(fpr))
+	fmt.Println("PGP key " + NormalizeFingerprint(fpr) + " is now trusted")
+}
+
+func cmdKeyReject(args []string) {
+	fpr := keyArg(args)
+	Check(RejectKey(fpr))
+	fmt.Println("pending PGP key " + NormalizeFingerprint(fpr) + " rejected")
+}
+
+func cmdResign(args []string) {
+	if !SigningEnabled() {
+		LogError("no key specified")
+	}
+	InitSigning()
+	for _, r := range Conf.Repos {
+		if len(r.SignKeys) == 0 {
+			continue
+		}
+		for _, db := range r.DBs() {
+			Check(ResignRepo(db))
+			fmt.Println("all packages in " + db + " are signed by " + strings.Join(ActiveSignKeys(r.SignKeys), ", ") + " now")
+		}
+	}
+}
+
+func cmdPromote(args []string) {
+	pkg := PkgByID(pkgIDArg(args))
+	InitSigning()
+	Check(Promote(pkg))
+	fmt.Println("package " + pkg.ID() + " promoted")
+}
+
+func cmdHold(args []string) {
+	if len(args) < 1 {
+		LogError("package expected\n" + usage())
+	}
+	id := pkgIDArg(args[:1])
+	reason := strings.Join(args[1:], " ")
+	if reason == "" {
+		reason = "held by hand"
+	}
+	Check(Hold(id, reason))
+	fmt.Println("package " + id + " will not be promoted automatically")
+}
+
+func cmdUnhold(args []string) {
+	id := pkgIDArg(args)
+	Check(Unhold(id))
+	fmt.Println("package " + id + " will be promoted automatically again")
+}
+
+func cmdSetup(args []string) {
+	if len(args) != 1 || args[0] != "--print-sudoers" {
+		LogError("unknown setup option\n" + usage())
+	}
+	fmt.Println(SudoersRules())
+}
+
+func cmdChroot(args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "migrate":
+		MigrateChroots()
+	case len(args) == 1 && args[0] == "prune":
+		PruneMasters()
+	case len(args) == 2 && args[0] == "rebuild":
+		if args[1] != "--all" {
+			pkgIDArg(args[1:])
+		}
+		CheckPrivilege()
+		for _, key := range rebuildTargets(args[1]) {
+			err := RebuildMaster(key)
+			if err != nil {
+				LogWarn("can not rebuild master chroot \"" + key + "\", see " + MasterLogFile(key) + ": " + err.Error())
+				continue
+			}
+			fmt.Println("Rebuilt master chroot \"" + key + "\"")
+		}
+	default:
+		LogError("unknown chroot subcommand\n" + usage())
+	}
+}
@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-07-28 21:00:43
- * @LastEditTime: 2025-08-03 22:34:51
+ * @LastEditTime: 2026-10-19 15:16:52
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /repo-donkey/conf.go
@@ -13,6 +13,7 @@ package main
 import (
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"slices"
 	"strconv"
@@ -42,6 +43,36 @@ const (
 	KEY_PKGBUILD     string = "PKGBUILD"
 	KEY_PRE_BUILD    string = "PreBuild"
 	KEY_POST_BUILD   string = "PostBuild"
+	KEY_VERIFY       string = "Verify"
+	KEY_NAMCAP       string = "Namcap"
+	KEY_NAMCAP_BLOCK string = "NamcapBlock"
+	KEY_ARCH         string = "Arch"
+	KEY_REVIEW       string = "Review"
+	KEY_TRUSTED      string = "TrustedMaintainers"
+	KEY_AUTO_BUMPS   string = "AutoApproveBumps"
+	KEY_BLOCK_RISK   string = "BlockOnRisk"
+	KEY_FREEZE       string = "FreezeOnMaintainerChange"
+	KEY_OFFICIAL     string = "OfficialAction"
+	KEY_KEYS_DIR     string = "KeysDir"
+	KEY_KEYSERVER    string = "Keyserver"
+	KEY_KEY_FILE     string = "KeyFile"
+	KEY_PASSPHRASE   string = "PassphraseFile"
+	KEY_EXPIRY_WARN  string = "KeyExpiryWarn"
+	KEY_ROTATION     string = "KeyRotation"
+	KEY_SNAPSHOT     string = "ChrootSnapshot"
+	KEY_MAX_FAILURES string = "ChrootMaxFailures"
+	KEY_MAINTENANCE  string = "ChrootMaintenance"
+	KEY_CHROOT_PKGS  string = "ChrootPackages"
+	KEY_CONF_APPEND  string = "MakepkgConfAppend"
+	KEY_VARIANTS     string = "Variants"
+	KEY_REPO         string = "Repo"
+	KEY_KEEP         string = "Keep"
+	KEY_PROMOTE_TO   string = "PromoteTo"
+	KEY_SOAK_TIME    string = "SoakTime"
+	KEY_ENV          string = "Env"
+	KEY_NO_CHECK     string = "NoCheck"
+	KEY_CH_NAMCAP    string = "ChrootNamcap"
+	KEY_TEMP_COPY    string = "ChrootTempCopy"
 )
 
 const (
@@ -49,6 +80,7 @@ const (
 	DIR_LOGS     string = "logs"
 	DIR_CHROOT   string = "chroot"
 	DIR_ROOT     string = "root"
+	DIR_CONFS    string = "confs"
 )
 
 const (
@@ -56,40 +88,100 @@ const (
 )
 
 const (
-	LOG_FILE_MKARCHROOT string = "mkarchroot.log"
+	ENV_PKG_NAME     string = "REPO_DONKEY_PKG_NAME"
+	ENV_BUILDING_DIR string = "REPO_DONKEY_BUILDING_DIR"
+	ENV_VARIANT      string = "REPO_DONKEY_VARIANT"
 )
 
+var PROXY_VARS = []string{"ALL_PROXY", "HTTP_PROXY", "HTTPS_PROXY", "all_proxy", "http_proxy", "https_proxy"}
+
+// Values of Env may contain commas, so they are separated by semicolons.
+const ENV_SEP string = ";"
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 const (
 	SIGN_USE_DEFAULT string = "DEFAULT"
+	SIGN_NONE        string = "NONE"
 )
 
 const AUR_URL_BASE string = "https://aur.archlinux.org/cgit/aur.git/plain/PKGBUILD?h="
 
 type Package struct {
-	Name       string
-	PKGBUILD   string
-	BuildProxy string
-	PreBuild   string
-	PostBuild  string
-	Priority   int
+	Name                     string
+	PKGBUILD                 string
+	BuildProxy               string
+	PreBuild                 string
+	PostBuild                string
+	Priority                 int
+	Verify                   bool
+	Namcap                   bool
+	NamcapBlock              []string
+	Review                   bool
+	TrustedMaintainers       []string
+	AutoApproveBumps         bool
+	BlockOnRisk              bool
+	FreezeOnMaintainerChange bool
+	OfficialAction           string
+	ChrootPackages           []string
+	MakepkgConf              string
+	PacmanConf               string
+	MakepkgConfAppend        string
+	MakepkgConfParts         []string
+	Variants                 []string
+	Variant                  string
+	Repos                    []string
+	TargetDBs                []string
+	Env                      []string
+	NoCheck                  bool
+	ChrootNamcap             bool
+	ChrootTempCopy           bool
 }
 
 type Config struct {
-	WorkingDir      string
-	TargetDB        string
-	BuildUser       string
-	BuildGroup      string
-	BuildProxy      string
-	MakepkgConf     string
-	PacmanConf      string
-	PkgSignKey      string
-	GlobalPreBuild  string
-	GlobalPostBuild string
-	DefaultPriority int
-	WorkersCnt      int
-	DebugMode       bool
-	Schedule        time.Duration
-	Packages        []Package
+	WorkingDir        string
+	TargetDB          string
+	BuildUser         string
+	BuildGroup        string
+	BuildProxy        string
+	MakepkgConf       string
+	PacmanConf        string
+	SignKeys          []string
+	Keep              int
+	KeyRotation       bool
+	SignKeyFile       string
+	PassphraseFile    string
+	KeyExpiryWarn     time.Duration
+	GlobalPreBuild    string
+	GlobalPostBuild   string
+	DefaultPriority   int
+	Arch              string
+	Verify            bool
+	Namcap            bool
+	NamcapBlock       []string
+	Review            bool
+	Trusted           []string
+	AutoBumps         bool
+	BlockOnRisk       bool
+	Freeze            bool
+	OfficialAction    string
+	LocalKeysDir      string
+	ChrootSnapshot    string
+	ChrootMaxFailures int
+	ChrootMaintenance time.Duration
+	ChrootPackages    []string
+	VariantDefs       []Variant
+	Variants          []string
+	Repos             []Repo
+	Env               []string
+	NoCheck           bool
+	ChrootNamcap      bool
+	ChrootTempCopy    bool
+	Keyserver         string
+	WorkersCnt        int
+	DebugMode         bool
+	Schedule          time.Duration
+	Packages          []Package
 }
 
 var Conf Config
@@ -129,6 +221,161 @@ func ConfValToBool(val string) bool {
 	return false
 }
 
+// "NONE" turns signing off, "DEFAULT" uses the default key of gpg.
+func ConfValToSignKeys(val string) []string {
+	if val == SIGN_NONE {
+		return make([]string, 0)
+	}
+	keys := ConfValToList(val)
+	if len(keys) > 1 && slices.Contains(keys, SIGN_USE_DEFAULT) {
+		LogError("\"" + SIGN_USE_DEFAULT + "\" can not be used with other keys")
+	}
+	return keys
+}
+
+// The base makepkg.conf with the snippets appended, parts[0] is the base.
+func makepkgConfContent(parts []string) ([]byte, error) {
+	content, err := os.ReadFile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, snippetFile := range parts[1:] {
+		snippet, err := os.ReadFile(snippetFile)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, []byte("\n# appended from "+snippetFile+"\n")...)
+		content = append(content, snippet...)
+	}
+	return content, nil
+}
+
+// Write the makepkg.conf of the package with the snippets appended to the
+// base one, and return its path. The privileged helper writes nothing, it
+// makes its own copy from the parts.
+func genMakepkgConf(pkg *Package, snippets []string) string {
+	base := pkg.MakepkgConf
+	if base == "" {
+		base = "/" + CONF_MAKEPKG
+	}
+	pkg.MakepkgConfParts = append([]string{base}, snippets...)
+	generated := path.Join(Conf.WorkingDir, DIR_CONFS, pkg.ID()+".makepkg.conf")
+	if privilegedRun() {
+		return generated
+	}
+	content, err := makepkgConfContent(pkg.MakepkgConfParts)
+	Check(err)
+	Check(os.MkdirAll(path.Dir(generated), os.ModePerm))
+	if !FileExists(generated) || !PanicOnErr(FileContentIs(generated, content)) {
+		// Replace instead of writing through, never follow a symlink.
+		tmp, err := os.CreateTemp(path.Dir(generated), path.Base(generated)+".*")
+		Check(err)
+		_, err = tmp.Write(content)
+		Check(err)
+		Check(tmp.Chmod(0644))
+		Check(tmp.Close())
+		Check(os.Rename(tmp.Name(), generated))
+	}
+	return generated
+}
+
+// The placeholder expands to the env var, never to the name itself, quoted
+// as fits where it is: outside quotes, in double quotes, or in single quotes,
+// where the quote is closed around it.
+func expandPkgNamePH(hook string) string {
+	var res strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(hook); i++ {
+		if strings.HasPrefix(hook[i:], PH_PKG_NAME) {
+			switch quote {
+			case '\'':
+				res.WriteString("'\"${" + ENV_PKG_NAME + "}\"'")
+			case '"':
+				res.WriteString("${" + ENV_PKG_NAME + "}")
+			default:
+				res.WriteString("\"${" + ENV_PKG_NAME + "}\"")
+			}
+			i += len(PH_PKG_NAME) - 1
+			continue
+		}
+		c := hook[i]
+		res.WriteByte(c)
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(hook):
+			i++
+			res.WriteByte(hook[i])
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
+	}
+	return res.String()
+}
+
+func ConfValToOfficialAction(val string) string {
+	if val != OFFICIAL_WARN && val != OFFICIAL_STOP && val != OFFICIAL_REMOVE {
+		LogError("invalid value \"" + val + "\" for key \"" + KEY_OFFICIAL + "\"")
+	}
+	return val
+}
+
+// Comma separated list, empty items are dropped.
+func ConfValToList(val string) []string {
+	res := make([]string, 0)
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Parse "NAME=value; NAME=value" into NAME=value items.
+func ConfValToEnv(val string) []string {
+	res := make([]string, 0)
+	for _, item := range strings.Split(val, ENV_SEP) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, _, found := strings.Cut(item, "=")
+		if !found || !envNameRegexp.MatchString(name) {
+			LogError("invalid item \"" + item + "\" for key \"" + KEY_ENV + "\"")
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+// Items of the package replace global ones with the same name.
+func mergeEnv(global []string, pkg []string) []string {
+	res := make([]string, 0, len(global)+len(pkg))
+	for _, item := range global {
+		name, _, _ := strings.Cut(item, "=")
+		if !slices.ContainsFunc(pkg, func(cur string) bool { return strings.HasPrefix(cur, name+"=") }) {
+			res = append(res, item)
+		}
+	}
+	return append(res, pkg...)
+}
+
+// Value of uname -m for the arch repo-donkey runs on.
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	case "riscv64":
+		return "riscv64"
+	}
+	return runtime.GOARCH
+}
+
 func getConf() {
 	if len(os.Args) < 2 {
 		LogError("no config file specified")
@@ -146,9 +393,7 @@ func getConf() {
 	chkKey(sec, SEC_GENERAL, KEY_USER)
 	chkKey(sec, SEC_GENERAL, KEY_GROUP)
 
-	if !DirExists(path.Dir(sec[KEY_TARGET_DB])) || !strings.HasSuffix(sec[KEY_TARGET_DB], ".db.tar.gz") {
-		LogError("invalid path for target database")
-	}
+	chkTargetDB(sec[KEY_TARGET_DB])
 
 	Conf.WorkingDir = sec[KEY_DIR]
 	Conf.TargetDB = sec[KEY_TARGET_DB]
@@ -157,7 +402,12 @@ func getConf() {
 	Conf.Packages = make([]Package, 0)
 	Conf.WorkersCnt = runtime.NumCPU()
 	Conf.Schedule = 24 * time.Hour
-	Conf.PkgSignKey = ""
+	Conf.SignKeys = make([]string, 0)
+	Conf.KeyRotation = false
+	Conf.Keep = 0
+	Conf.SignKeyFile = ""
+	Conf.PassphraseFile = ""
+	Conf.KeyExpiryWarn = 30 * 24 * time.Hour
 	Conf.BuildProxy = ""
 	Conf.MakepkgConf = ""
 	Conf.PacmanConf = ""
@@ -165,9 +415,46 @@ func getConf() {
 	Conf.GlobalPreBuild = ""
 	Conf.GlobalPostBuild = ""
 	Conf.DefaultPriority = 0
+	Conf.Arch = hostArch()
+	Conf.Verify = false
+	Conf.Namcap = false
+	Conf.NamcapBlock = make([]string, 0)
+	Conf.Review = false
+	Conf.Trusted = make([]string, 0)
+	Conf.AutoBumps = false
+	Conf.BlockOnRisk = false
+	Conf.Freeze = false
+	Conf.OfficialAction = OFFICIAL_WARN
+	Conf.LocalKeysDir = ""
+	Conf.Keyserver = ""
+	Conf.ChrootSnapshot = SNAPSHOT_AUTO
+	Conf.ChrootMaxFailures = 3
+	Conf.ChrootMaintenance = 24 * time.Hour
+	Conf.ChrootPackages = []string{PKG_BASE_DEVEL}
+	Conf.Env = make([]string, 0)
+	Conf.NoCheck = false
+	Conf.ChrootNamcap = false
+	Conf.ChrootTempCopy = false
+	Conf.VariantDefs = readVariants(conf)
+	Conf.Variants = append([]string{VARIANT_DEFAULT}, VariantNames()...)
 
 	if sec.HasKey(KEY_KEY) {
-		Conf.PkgSignKey = sec[KEY_KEY]
+		Conf.SignKeys = ConfValToSignKeys(sec[KEY_KEY])
+	}
+	if sec.HasKey(KEY_KEEP) {
+		Conf.Keep = ConfValToInt(sec[KEY_KEEP])
+	}
+	if sec.HasKey(KEY_ROTATION) {
+		Conf.KeyRotation = ConfValToBool(sec[KEY_ROTATION])
+	}
+	if sec.HasKey(KEY_KEY_FILE) {
+		Conf.SignKeyFile = sec[KEY_KEY_FILE]
+	}
+	if sec.HasKey(KEY_PASSPHRASE) {
+		Conf.PassphraseFile = sec[KEY_PASSPHRASE]
+	}
+	if sec.HasKey(KEY_EXPIRY_WARN) {
+		Conf.KeyExpiryWarn = ConfValToDuration(sec[KEY_EXPIRY_WARN])
 	}
 	if sec.HasKey(KEY_SCHEDULE) {
 		Conf.Schedule = ConfValToDuration(sec[KEY_SCHEDULE])
@@ -193,22 +480,110 @@ func getConf() {
 	if sec.HasKey(KEY_PRIORITY) {
 		Conf.DefaultPriority = ConfValToInt(sec[KEY_PRIORITY])
 	}
+	if sec.HasKey(KEY_ARCH) {
+		Conf.Arch = sec[KEY_ARCH]
+	}
+	if sec.HasKey(KEY_VERIFY) {
+		Conf.Verify = ConfValToBool(sec[KEY_VERIFY])
+	}
+	if sec.HasKey(KEY_NAMCAP) {
+		Conf.Namcap = ConfValToBool(sec[KEY_NAMCAP])
+	}
+	if sec.HasKey(KEY_NAMCAP_BLOCK) {
+		Conf.NamcapBlock = ConfValToList(sec[KEY_NAMCAP_BLOCK])
+	}
+	if sec.HasKey(KEY_REVIEW) {
+		Conf.Review = ConfValToBool(sec[KEY_REVIEW])
+	}
+	if sec.HasKey(KEY_TRUSTED) {
+		Conf.Trusted = ConfValToList(sec[KEY_TRUSTED])
+	}
+	if sec.HasKey(KEY_AUTO_BUMPS) {
+		Conf.AutoBumps = ConfValToBool(sec[KEY_AUTO_BUMPS])
+	}
+	if sec.HasKey(KEY_BLOCK_RISK) {
+		Conf.BlockOnRisk = ConfValToBool(sec[KEY_BLOCK_RISK])
+	}
+	if sec.HasKey(KEY_FREEZE) {
+		Conf.Freeze = ConfValToBool(sec[KEY_FREEZE])
+	}
+	if sec.HasKey(KEY_OFFICIAL) {
+		Conf.OfficialAction = ConfValToOfficialAction(sec[KEY_OFFICIAL])
+	}
+	if sec.HasKey(KEY_KEYS_DIR) {
+		Conf.LocalKeysDir = sec[KEY_KEYS_DIR]
+	}
+	if sec.HasKey(KEY_KEYSERVER) {
+		Conf.Keyserver = sec[KEY_KEYSERVER]
+	}
+	if sec.HasKey(KEY_SNAPSHOT) {
+		Conf.ChrootSnapshot = ConfValToSnapshotMode(sec[KEY_SNAPSHOT])
+	}
+	if sec.HasKey(KEY_MAX_FAILURES) {
+		Conf.ChrootMaxFailures = ConfValToInt(sec[KEY_MAX_FAILURES])
+	}
+	if sec.HasKey(KEY_MAINTENANCE) {
+		Conf.ChrootMaintenance = ConfValToDuration(sec[KEY_MAINTENANCE])
+		if Conf.ChrootMaintenance <= 0 {
+			LogError("\"" + KEY_MAINTENANCE + "\" must be positive")
+		}
+	}
+	if sec.HasKey(KEY_CHROOT_PKGS) {
+		Conf.ChrootPackages = ConfValToList(sec[KEY_CHROOT_PKGS])
+		if len(Conf.ChrootPackages) == 0 {
+			LogError("\"" + KEY_CHROOT_PKGS + "\" can not be empty")
+		}
+	}
+	if sec.HasKey(KEY_VARIANTS) {
+		Conf.Variants = ConfValToVariants(sec[KEY_VARIANTS])
+	}
+	if sec.HasKey(KEY_ENV) {
+		Conf.Env = ConfValToEnv(sec[KEY_ENV])
+	}
+	if sec.HasKey(KEY_NO_CHECK) {
+		Conf.NoCheck = ConfValToBool(sec[KEY_NO_CHECK])
+	}
+	if sec.HasKey(KEY_CH_NAMCAP) {
+		Conf.ChrootNamcap = ConfValToBool(sec[KEY_CH_NAMCAP])
+	}
+	if sec.HasKey(KEY_TEMP_COPY) {
+		Conf.ChrootTempCopy = ConfValToBool(sec[KEY_TEMP_COPY])
+	}
 	if sec.HasKey(KEY_DEBUG_MODE) {
 		Conf.DebugMode = ConfValToBool(sec[KEY_DEBUG_MODE])
 	}
+	Conf.Repos = readRepos(conf)
 
 	for pkgName, pkgConf := range conf {
-		curPkg := Package{
-			Name:       pkgName,
-			PKGBUILD:   AUR_URL_BASE + pkgName,
-			BuildProxy: Conf.BuildProxy,
-			PreBuild:   Conf.GlobalPreBuild,
-			PostBuild:  Conf.GlobalPostBuild,
-			Priority:   Conf.DefaultPriority,
-		}
-		if pkgName == SEC_GENERAL || pkgName == "" {
+		// Keys before the first section are put into the unnamed section.
+		if pkgName == "" || pkgName == SEC_GENERAL || IsVariantSection(pkgName) || IsRepoSection(pkgName) {
 			continue
 		}
+		curPkg := Package{
+			Name:                     pkgName,
+			PKGBUILD:                 AUR_URL_BASE + pkgName,
+			BuildProxy:               Conf.BuildProxy,
+			MakepkgConf:              Conf.MakepkgConf,
+			PacmanConf:               Conf.PacmanConf,
+			Repos:                    []string{REPO_DEFAULT},
+			Env:                      Conf.Env,
+			NoCheck:                  Conf.NoCheck,
+			ChrootNamcap:             Conf.ChrootNamcap,
+			ChrootTempCopy:           Conf.ChrootTempCopy,
+			Variants:                 Conf.Variants,
+			PreBuild:                 Conf.GlobalPreBuild,
+			PostBuild:                Conf.GlobalPostBuild,
+			Priority:                 Conf.DefaultPriority,
+			Verify:                   Conf.Verify,
+			Namcap:                   Conf.Namcap,
+			NamcapBlock:              Conf.NamcapBlock,
+			Review:                   Conf.Review,
+			TrustedMaintainers:       Conf.Trusted,
+			AutoApproveBumps:         Conf.AutoBumps,
+			BlockOnRisk:              Conf.BlockOnRisk,
+			FreezeOnMaintainerChange: Conf.Freeze,
+			OfficialAction:           Conf.OfficialAction,
+		}
 		if !pkgConf.HasKey(KEY_PKGBUILD) {
 			LogInfo("building process of package " + pkgName + " will based on PKGBUILD downloaded from AUR")
 		} else {
@@ -217,6 +592,21 @@ func getConf() {
 		if pkgConf.HasKey(KEY_PROXY) {
 			curPkg.BuildProxy = pkgConf[KEY_PROXY]
 		}
+		if pkgConf.HasKey(KEY_MAKEPKG_CONF) {
+			curPkg.MakepkgConf = pkgConf[KEY_MAKEPKG_CONF]
+		}
+		if pkgConf.HasKey(KEY_PACMAN_CONF) {
+			curPkg.PacmanConf = pkgConf[KEY_PACMAN_CONF]
+		}
+		if pkgConf.HasKey(KEY_CONF_APPEND) {
+			curPkg.MakepkgConfAppend = pkgConf[KEY_CONF_APPEND]
+		}
+		if pkgConf.HasKey(KEY_REPO) {
+			curPkg.Repos = ConfValToRepos(pkgConf[KEY_REPO])
+		}
+		if pkgConf.HasKey(KEY_VARIANTS) {
+			curPkg.Variants = ConfValToVariants(pkgConf[KEY_VARIANTS])
+		}
 		if pkgConf.HasKey(KEY_PRE_BUILD) {
 			curPkg.PreBuild = pkgConf[KEY_PRE_BUILD]
 		}
@@ -226,9 +616,52 @@ func getConf() {
 		if pkgConf.HasKey(KEY_PRIORITY) {
 			curPkg.Priority = ConfValToInt(pkgConf[KEY_PRIORITY])
 		}
-		curPkg.PreBuild = strings.ReplaceAll(curPkg.PreBuild, PH_PKG_NAME, pkgName)
-		curPkg.PostBuild = strings.ReplaceAll(curPkg.PostBuild, PH_PKG_NAME, pkgName)
-		Conf.Packages = append(Conf.Packages, curPkg)
+		if pkgConf.HasKey(KEY_VERIFY) {
+			curPkg.Verify = ConfValToBool(pkgConf[KEY_VERIFY])
+		}
+		if pkgConf.HasKey(KEY_NAMCAP) {
+			curPkg.Namcap = ConfValToBool(pkgConf[KEY_NAMCAP])
+		}
+		if pkgConf.HasKey(KEY_NAMCAP_BLOCK) {
+			curPkg.NamcapBlock = ConfValToList(pkgConf[KEY_NAMCAP_BLOCK])
+		}
+		if pkgConf.HasKey(KEY_REVIEW) {
+			curPkg.Review = ConfValToBool(pkgConf[KEY_REVIEW])
+		}
+		if pkgConf.HasKey(KEY_TRUSTED) {
+			curPkg.TrustedMaintainers = ConfValToList(pkgConf[KEY_TRUSTED])
+		}
+		if pkgConf.HasKey(KEY_AUTO_BUMPS) {
+			curPkg.AutoApproveBumps = ConfValToBool(pkgConf[KEY_AUTO_BUMPS])
+		}
+		if pkgConf.HasKey(KEY_BLOCK_RISK) {
+			curPkg.BlockOnRisk = ConfValToBool(pkgConf[KEY_BLOCK_RISK])
+		}
+		if pkgConf.HasKey(KEY_FREEZE) {
+			curPkg.FreezeOnMaintainerChange = ConfValToBool(pkgConf[KEY_FREEZE])
+		}
+		if pkgConf.HasKey(KEY_OFFICIAL) {
+			curPkg.OfficialAction = ConfValToOfficialAction(pkgConf[KEY_OFFICIAL])
+		}
+		// Extra packages on top of the global ones, not a replacement.
+		if pkgConf.HasKey(KEY_CHROOT_PKGS) {
+			curPkg.ChrootPackages = ConfValToList(pkgConf[KEY_CHROOT_PKGS])
+		}
+		if pkgConf.HasKey(KEY_ENV) {
+			curPkg.Env = mergeEnv(Conf.Env, ConfValToEnv(pkgConf[KEY_ENV]))
+		}
+		if pkgConf.HasKey(KEY_NO_CHECK) {
+			curPkg.NoCheck = ConfValToBool(pkgConf[KEY_NO_CHECK])
+		}
+		if pkgConf.HasKey(KEY_CH_NAMCAP) {
+			curPkg.ChrootNamcap = ConfValToBool(pkgConf[KEY_CH_NAMCAP])
+		}
+		if pkgConf.HasKey(KEY_TEMP_COPY) {
+			curPkg.ChrootTempCopy = ConfValToBool(pkgConf[KEY_TEMP_COPY])
+		}
+		curPkg.PreBuild = expandPkgNamePH(curPkg.PreBuild)
+		curPkg.PostBuild = expandPkgNamePH(curPkg.PostBuild)
+		Conf.Packages = append(Conf.Packages, expandVariants(curPkg)...)
 	}
 	sortFunc := func(a Package, b Package) int {
 		if a.Priority > b.Priority {
@@ -241,3 +674,12 @@ func getConf() {
 	}
 	slices.SortFunc(Conf.Packages, sortFunc)
 }
+
+func PkgByName(name string) *Package {
+	for i := range Conf.Packages {
+		if Conf.Packages[i].Name == name {
+			return &Conf.Packages[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 15:16:46
+ * @LastEditTime: 2026-10-19 15:16:52
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/conf_test.go
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestExpandPkgNamePH(t *testing.T) {
+	const name = "foo bar;$(id)'\""
+	cases := []struct {
+		hook string
+		want string
+	}{
+		{"printf %s " + PH_PKG_NAME, name},
+		{"printf %s \"" + PH_PKG_NAME + "\"", name},
+		{"printf %s '" + PH_PKG_NAME + "'", name},
+		{"printf %s \"x-" + PH_PKG_NAME + "-y\"", "x-" + name + "-y"},
+		{"printf %s 'x-" + PH_PKG_NAME + "-y'", "x-" + name + "-y"},
+		{"printf %s \"it's \" '\"" + PH_PKG_NAME + "\"'", "it's \"" + name + "\""},
+		{"printf %s \\'" + PH_PKG_NAME, "'" + name},
+	}
+	for _, c := range cases {
+		cmd := exec.Command(BIN_BASH, "-c", expandPkgNamePH(c.hook))
+		cmd.Env = append(os.Environ(), ENV_PKG_NAME+"="+name)
+		out, err := cmd.Output()
+		if err != nil || string(out) != c.want {
+			t.Errorf("%s: got %q (%v), want %q", c.hook, out, err, c.want)
+		}
+	}
+}
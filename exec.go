@@ -0,0 +1,73 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:29:04
+ * @LastEditTime: 2026-10-19 15:00:58
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/exec.go
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"slices"
+)
+
+const BIN_ENV string = "/usr/bin/env"
+
+// An external command, always given as argv and never as a shell line, so
+// no value can be interpreted by a shell. Env holds extra KEY=VALUE pairs,
+// the command runs as User and Group through sudo when they are not the
+// current user.
+type ExtCmd struct {
+	Argv  []string
+	Env   []string
+	Dir   string
+	User  string
+	Group string
+}
+
+func (c *ExtCmd) toRun() []string {
+	toRun := make([]string, 0)
+	if c.User != "" && !IsCurrentUser(c.User) {
+		toRun = append(toRun, BIN_SUDO, "-u", c.User, "-g", c.Group)
+		// sudo resets the environment, so pass the extra env via env(1).
+		if len(c.Env) > 0 {
+			toRun = append(toRun, BIN_ENV)
+			toRun = append(toRun, c.Env...)
+		}
+	}
+	if Rootless() && slices.Contains(PrivilegedTools, c.Argv[0]) {
+		return append(toRun, privilegedArgv(c.Argv)...)
+	}
+	return append(toRun, c.Argv...)
+}
+
+func (c *ExtCmd) command() (*exec.Cmd, []string) {
+	toRun := c.toRun()
+	cmd := exec.Command(toRun[0], toRun[1:]...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd, toRun
+}
+
+func (c *ExtCmd) Run(logTo string) error {
+	cmd, toRun := c.command()
+	return RunWithLog(cmd, toRun, logTo)
+}
+
+// Run the command and return its stdout, stderr goes to the log file. The
+// stdout is returned even on error, as some tools report with exit status.
+func (c *ExtCmd) Output(logTo string) ([]byte, error) {
+	cmd, toRun := c.command()
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := RunWithLog(cmd, toRun, logTo)
+	return stdout.Bytes(), err
+}
@@ -0,0 +1,194 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:32:56
+ * @LastEditTime: 2026-10-19 15:13:34
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/health.go
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FILE_CHROOT_LOCK  string = "chroot.lock"
+	FILE_FAILURES     string = "failures"
+	FILE_ARCH_CHROOT  string = ".arch-chroot"
+	FILE_PACMAN_DBLCK string = "/var/lib/pacman/db.lck"
+	DIR_PACMAN_LOCAL  string = "var/lib/pacman/local"
+	SUFFIX_BROKEN     string = ".broken-"
+)
+
+// makepkg prints it once the build itself starts, makechrootpkg failing
+// before it means the chroot failed, not the package.
+const MAKEPKG_STARTED string = "==> Making package:"
+
+// Signs of a broken keyring in the output of pacman.
+var keyringErrors = []string{"(PGP signature)", "unknown trust", "GPGME error", "keyring is not writable"}
+
+// Held exclusively while the master is recreated, updated or maintained,
+// and shared by builds while an overlay is mounted on it.
+func ChrootLockFile(key string) string {
+	return path.Join(MasterDir(key), FILE_CHROOT_LOCK)
+}
+
+func failuresFile(key string) string {
+	return path.Join(MasterDir(key), FILE_FAILURES)
+}
+
+// Why the master chroot is considered broken, empty if it looks fine.
+func MasterBroken(key string) string {
+	root := MasterRoot(key)
+	if !FileExists(path.Join(root, FILE_ARCH_CHROOT)) {
+		return "the " + FILE_ARCH_CHROOT + " marker is missing, mkarchroot may have been interrupted"
+	}
+	if slices.Contains(MasterPackages(key), PKG_BASE_DEVEL) {
+		found, err := filepath.Glob(path.Join(root, DIR_PACMAN_LOCAL, PKG_BASE_DEVEL+"-*"))
+		if err != nil || len(found) == 0 {
+			return PKG_BASE_DEVEL + " is not installed"
+		}
+	}
+	return ""
+}
+
+func ChrootFailures(key string) int {
+	data, err := os.ReadFile(failuresFile(key))
+	if err != nil {
+		return 0
+	}
+	cnt, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return cnt
+}
+
+func countChrootFailure(key string) int {
+	cnt := ChrootFailures(key) + 1
+	err := os.WriteFile(failuresFile(key), []byte(strconv.Itoa(cnt)+"\n"), 0644)
+	if err != nil {
+		LogWarn("can not record failures of master chroot \"" + key + "\": " + err.Error())
+	}
+	return cnt
+}
+
+// A build failed in the chroot phase, or on a broken keyring. The master is recreated after
+// ChrootMaxFailures such failures in a row, at once if it is not busy,
+// otherwise when it is prepared in the next round.
+func chrootBuildFailed(key string, logFile string) {
+	cnt := countChrootFailure(key)
+	LogWarn("build in master chroot \"" + key + "\" failed because of the chroot (" + strconv.Itoa(cnt) + " time(s) in a row), see " + logFile)
+	if cnt < Conf.ChrootMaxFailures {
+		return
+	}
+	lockFile, err := tryLockMaster(key)
+	if err == ErrLocked {
+		return
+	}
+	if err == nil {
+		LogWarn("master chroot \"" + key + "\" failed " + strconv.Itoa(cnt) + " time(s) in a row, will recreate it")
+		err = rebuildMaster(key)
+		Unlock(lockFile)
+	}
+	if err != nil {
+		LogWarn("can not recreate master chroot \"" + key + "\", see " + MasterLogFile(key) + ": " + err.Error())
+	}
+}
+
+func resetChrootFailures(key string) {
+	err := os.Remove(failuresFile(key))
+	if err != nil && !os.IsNotExist(err) {
+		LogWarn("can not reset failures of master chroot \"" + key + "\": " + err.Error())
+	}
+}
+
+// What was appended to the log since it had the size.
+func logSince(logFile string, size int64) string {
+	file, err := os.Open(logFile)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	_, err = file.Seek(size, io.SeekStart)
+	if err != nil {
+		return ""
+	}
+	data, _ := io.ReadAll(file)
+	return string(data)
+}
+
+func logSize(logFile string) int64 {
+	info, err := os.Stat(logFile)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func hasKeyringError(output string) bool {
+	for _, sign := range keyringErrors {
+		if strings.Contains(output, sign) {
+			return true
+		}
+	}
+	return false
+}
+
+// Throw the master chroot away and create it again. The chroot lock keeps
+// other master operations and overlay builds out, root.lock keeps builds
+// from copying it meanwhile.
+func RebuildMaster(key string) error {
+	err := initMasterDirs(key)
+	if err != nil {
+		return err
+	}
+	chrootLock, err := Lock(ChrootLockFile(key))
+	if err != nil {
+		return err
+	}
+	defer Unlock(chrootLock)
+	return rebuildMaster(key)
+}
+
+// Caller must hold the chroot lock.
+func rebuildMaster(key string) error {
+	rootLock, err := Lock(path.Join(MasterDir(key), FILE_ROOT_LOCK))
+	if err != nil {
+		return err
+	}
+	defer Unlock(rootLock)
+	if DirExists(MasterRoot(key)) {
+		// Moving it away needs no root, so a new master can be created even
+		// if the old one can not be removed.
+		broken := MasterRoot(key) + SUFFIX_BROKEN + strconv.FormatInt(time.Now().Unix(), 10)
+		err = os.Rename(MasterRoot(key), broken)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(broken)
+		if err != nil {
+			LogWarn("can not remove old master chroot " + broken + ", please remove it as root: " + err.Error())
+		}
+	}
+	LogInfo("creating master chroot \"" + key + "\"...")
+	args := append(append(masterArgs(key), MasterRoot(key)), MasterPackages(key)...)
+	err = SudoRun(Conf.BuildUser, Conf.BuildGroup, MasterLogFile(key), BIN_MKARCHROOT, args...)
+	if err != nil {
+		return err
+	}
+	saveInstalledPackages(key, MasterPackages(key))
+	resetChrootFailures(key)
+	saveMaintenance(key, MaintenanceState{Time: time.Now(), OK: true, Detail: "recreated"})
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:19:38
+ * @LastEditTime: 2026-10-19 14:20:31
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/history.go
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const DIR_HISTORY string = "history"
+
+const (
+	EVENT_BUILD string = "build"
+)
+
+const (
+	RESULT_OK      string = "ok"
+	RESULT_FAILED  string = "failed"
+	RESULT_SKIPPED string = "skipped"
+)
+
+type BuildRecord struct {
+	Time     time.Time `json:"time"`
+	Package  string    `json:"package"`
+	Event    string    `json:"event"`
+	Result   string    `json:"result"`
+	Detail   string    `json:"detail,omitempty"`
+	Findings []Finding `json:"findings,omitempty"`
+}
+
+var historyLock sync.Mutex
+
+func HistoryDir() string {
+	return path.Join(Conf.WorkingDir, DIR_HISTORY)
+}
+
+func PkgHistoryFile(pkgName string) string {
+	return path.Join(HistoryDir(), pkgName+".jsonl")
+}
+
+// Append the record as one JSON line to the history file of the package.
+func AppendHistory(rec *BuildRecord) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = os.MkdirAll(HistoryDir(), os.ModePerm)
+	}
+	if err == nil {
+		err = AppendToFile(PkgHistoryFile(rec.Package), append(data, '\n'))
+	}
+	if err != nil {
+		LogWarn("can not write history of package " + rec.Package + ": " + err.Error())
+	}
+}
+
+func ReadHistory(pkgName string) ([]BuildRecord, error) {
+	res := make([]BuildRecord, 0)
+	file, err := os.Open(PkgHistoryFile(pkgName))
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec BuildRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			res = append(res, rec)
+		}
+	}
+	return res, scanner.Err()
+}
@@ -0,0 +1,193 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:22:57
+ * @LastEditTime: 2026-10-19 15:04:07
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/keyring.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	DIR_KEYS         string = "keys"
+	DIR_KEYS_TRUSTED string = "trusted"
+	DIR_KEYS_PENDING string = "pending"
+)
+
+const (
+	SUFFIX_KEY          string = ".asc"
+	SUFFIX_KEY_REJECTED string = ".rejected"
+)
+
+var fingerprintRegexp = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+func KeysDir() string {
+	return path.Join(Conf.WorkingDir, DIR_KEYS)
+}
+
+func trustedKeyFile(fpr string) string {
+	return path.Join(KeysDir(), DIR_KEYS_TRUSTED, fpr+SUFFIX_KEY)
+}
+
+func pendingKeyFile(fpr string) string {
+	return path.Join(KeysDir(), DIR_KEYS_PENDING, fpr+SUFFIX_KEY)
+}
+
+func NormalizeFingerprint(fpr string) string {
+	return strings.ToUpper(strings.ReplaceAll(fpr, " ", ""))
+}
+
+func InitKeysDir() {
+	Check(os.MkdirAll(path.Join(KeysDir(), DIR_KEYS_TRUSTED), os.ModePerm))
+	Check(os.MkdirAll(path.Join(KeysDir(), DIR_KEYS_PENDING), os.ModePerm))
+}
+
+// List the fingerprints of keys in the trusted or pending dir.
+func ListKeys(which string) []string {
+	res := make([]string, 0)
+	entries, err := os.ReadDir(path.Join(KeysDir(), which))
+	if err != nil {
+		return res
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), SUFFIX_KEY) {
+			res = append(res, strings.TrimSuffix(e.Name(), SUFFIX_KEY))
+		}
+	}
+	return res
+}
+
+// Receive the key into a throwaway homedir and export it as pending, so
+// nothing from a keyserver is used before someone approves it.
+func fetchKey(fpr string, logFile string) error {
+	home, err := os.MkdirTemp("", "repo-donkey-gnupg-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	recv := ExtCmd{Argv: []string{BIN_GPG, "--homedir", home, "--batch", "--keyserver", Conf.Keyserver, "--recv-keys", fpr}}
+	err = recv.Run(logFile)
+	if err != nil {
+		return err
+	}
+	export := ExtCmd{Argv: []string{BIN_GPG, "--homedir", home, "--batch", "--yes", "--armor", "--output", pendingKeyFile(fpr), "--export", fpr}}
+	return export.Run(logFile)
+}
+
+// Whether the key is already in the keyring of the build user, for example
+// imported by hand before the trusted keys dir existed.
+func inBuildKeyring(fpr string, logFile string) bool {
+	cmd := ExtCmd{Argv: []string{BIN_GPG, "--batch", "--with-colons", "--list-keys", fpr}, User: Conf.BuildUser, Group: Conf.BuildGroup}
+	out, err := cmd.Output(logFile)
+	return err == nil && slices.Contains(colonFingerprints(string(out)), fpr)
+}
+
+// Fingerprints in "gpg --with-colons" output, the primary key of each
+// "pub" record comes first.
+func colonFingerprints(out string) []string {
+	res := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 9 && fields[0] == "fpr" {
+			res = append(res, fields[9])
+		}
+	}
+	return res
+}
+
+// Check the key file holds exactly one key, the one with the fingerprint.
+func checkKeyFile(file string, fpr string, logFile string) error {
+	cmd := ExtCmd{Argv: []string{BIN_GPG, "--batch", "--with-colons", "--show-keys", file}}
+	out, err := cmd.Output(logFile)
+	if err != nil {
+		return errors.New("can not read key file \"" + file + "\": " + err.Error())
+	}
+	if strings.Count("\n"+string(out), "\npub:") != 1 {
+		return errors.New("key file \"" + file + "\" does not hold exactly one key")
+	}
+	if !slices.Contains(colonFingerprints(string(out)), fpr) {
+		return errors.New("key file \"" + file + "\" does not hold key " + fpr)
+	}
+	return nil
+}
+
+// Make sure every key in validpgpkeys is in the keyring of the build user.
+// Keys not there yet must be trusted: keys found in the local keys dir are
+// trusted directly, keys from the keyserver wait for approval.
+func PrepareKeys(pkg *Package, logFile string) error {
+	defer lockPkgName(pkg.Name).Unlock()
+	srcinfo, err := GenSrcinfo(pkg, logFile)
+	if err != nil {
+		return errors.New("can not generate .SRCINFO: " + err.Error())
+	}
+	missing := make([]string, 0)
+	for _, fpr := range srcinfo.ValidPGPKeys {
+		fpr = NormalizeFingerprint(fpr)
+		if !fingerprintRegexp.MatchString(fpr) {
+			LogWarn("package " + pkg.Name + " lists an invalid fingerprint \"" + fpr + "\" in validpgpkeys")
+			continue
+		}
+		if inBuildKeyring(fpr, logFile) {
+			continue
+		}
+		if !FileExists(trustedKeyFile(fpr)) && Conf.LocalKeysDir != "" && FileExists(path.Join(Conf.LocalKeysDir, fpr+SUFFIX_KEY)) {
+			err := checkKeyFile(path.Join(Conf.LocalKeysDir, fpr+SUFFIX_KEY), fpr, logFile)
+			if err != nil {
+				return err
+			}
+			err = CopyAndOverwrite(trustedKeyFile(fpr), path.Join(Conf.LocalKeysDir, fpr+SUFFIX_KEY))
+			if err != nil {
+				return err
+			}
+			LogInfo("trusted PGP key " + fpr + " from \"" + Conf.LocalKeysDir + "\"")
+		}
+		if FileExists(trustedKeyFile(fpr)) {
+			err := SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, BIN_GPG, "--batch", "--import", trustedKeyFile(fpr))
+			if err != nil {
+				return errors.New("can not import PGP key " + fpr + ": " + err.Error())
+			}
+			continue
+		}
+		if !FileExists(pendingKeyFile(fpr)) && !FileExists(pendingKeyFile(fpr)+SUFFIX_KEY_REJECTED) && Conf.Keyserver != "" {
+			err := fetchKey(fpr, logFile)
+			if err != nil {
+				LogWarn("can not fetch PGP key " + fpr + " from " + Conf.Keyserver + ": " + err.Error())
+			} else {
+				LogWarn("PGP key " + fpr + " needed by package " + pkg.Name + " fetched, it awaits approval")
+			}
+		}
+		missing = append(missing, fpr)
+	}
+	if len(missing) > 0 {
+		return errors.New("PGP key(s) " + strings.Join(missing, ", ") + " not trusted, run \"repo-donkey <config> key-approve <fingerprint>\" once reviewed")
+	}
+	return nil
+}
+
+func ApproveKey(fpr string) error {
+	fpr = NormalizeFingerprint(fpr)
+	if !FileExists(pendingKeyFile(fpr)) {
+		return errors.New("no pending PGP key " + fpr)
+	}
+	return os.Rename(pendingKeyFile(fpr), trustedKeyFile(fpr))
+}
+
+func RejectKey(fpr string) error {
+	fpr = NormalizeFingerprint(fpr)
+	if !FileExists(pendingKeyFile(fpr)) {
+		return errors.New("no pending PGP key " + fpr)
+	}
+	// Kept, so it will not be fetched again.
+	return os.Rename(pendingKeyFile(fpr), pendingKeyFile(fpr)+SUFFIX_KEY_REJECTED)
+}
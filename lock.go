@@ -0,0 +1,91 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:14:49
+ * @LastEditTime: 2026-10-19 14:52:24
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/lock.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+const FILE_LOCK string = "LOCK"
+
+const FILE_DAEMON_LOCK string = "daemon.lock"
+
+// Held as long as the daemon runs, so a second daemon can never take the
+// running jobs of the first one as interrupted.
+var daemonLock *os.File
+
+var ErrLocked = errors.New("locked by another process")
+
+func PkgLockFile(pkg *Package) string {
+	return path.Join(PkgBuildingDir(pkg), FILE_LOCK)
+}
+
+// Take an exclusive flock on the file without blocking, the lock is released
+// by the kernel if the process dies, so stale lock files are harmless.
+func TryLock(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	if file.Truncate(0) == nil {
+		file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	}
+	return file, nil
+}
+
+func Unlock(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
+
+func LockWorkingDir() {
+	file, err := TryLock(path.Join(Conf.WorkingDir, FILE_DAEMON_LOCK))
+	if err == ErrLocked {
+		LogError("another repo-donkey daemon is using working dir \"" + Conf.WorkingDir + "\"")
+	}
+	Check(err)
+	daemonLock = file
+}
+
+// Like TryLock, but waits until the lock is available.
+func Lock(name string) (*os.File, error) {
+	return lockWith(name, syscall.LOCK_EX)
+}
+
+// Wait for a shared lock, which only excludes exclusive holders.
+func LockShared(name string) (*os.File, error) {
+	return lockWith(name, syscall.LOCK_SH)
+}
+
+func lockWith(name string, how int) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), how)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-07-28 10:56:55
- * @LastEditTime: 2025-08-03 23:50:28
+ * @LastEditTime: 2026-10-19 14:52:24
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /repo-donkey/main.go
@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -23,60 +24,155 @@ const FLG_FILE_NO_ERR_BEFORE string = "LAST-BUILD-OK"
 
 var JobsWg sync.WaitGroup
 
-func buildAll(limiter chan struct{}, stop chan struct{}) {
-buildloop:
+// IDs of free workers, each worker builds in its own copy of the chroot.
+type WorkerPool chan int
+
+func NewWorkerPool(cnt int) WorkerPool {
+	pool := make(WorkerPool, cnt)
+	for i := 1; i <= cnt; i++ {
+		pool <- i
+	}
+	return pool
+}
+
+// Returns false if the job should stay queued and be dispatched again.
+func runJob(pkg *Package, worker int) bool {
+	rec := &BuildRecord{Time: time.Now(), Package: pkg.ID(), Event: EVENT_BUILD, Result: RESULT_FAILED}
+	defer AppendHistory(rec)
+	fail := func(msg string, err error) {
+		rec.Detail = msg + ": " + err.Error()
+		LogWarn(rec.Detail)
+	}
+	lockFile, err := TryLock(PkgLockFile(pkg))
+	if err == ErrLocked {
+		rec.Result = RESULT_SKIPPED
+		rec.Detail = "building dir is locked by another process, stays queued"
+		LogWarn("package " + pkg.ID() + " stays queued: building dir is locked by another process")
+		return false
+	}
+	if err != nil {
+		fail("can not start to build "+pkg.ID()+": can not lock building dir", err)
+		return true
+	}
+	defer Unlock(lockFile)
+	if reason := FrozenReason(pkg.Name); reason != "" {
+		rec.Result = RESULT_SKIPPED
+		rec.Detail = "frozen: " + reason
+		LogWarn("skiped the build process of package " + pkg.ID() + ": frozen since it " + reason)
+		return true
+	}
+	if where := OfficialStop(pkg); where != "" {
+		rec.Result = RESULT_SKIPPED
+		rec.Detail = "available from the official repos as " + where
+		LogWarn("skiped the build process of package " + pkg.ID() + ": available from the official repos as " + where)
+		return true
+	}
+	LogInfo("will build package " + pkg.ID() + "...")
+	logFile, changed, err := PreBuildPrepare(pkg, rec)
+	if err != nil {
+		fail("can not start to build "+pkg.ID(), err)
+		return true
+	}
+	if !changed && FileExists(path.Join(PkgBuildingDir(pkg), FLG_FILE_NO_ERR_BEFORE)) {
+		rec.Result = RESULT_SKIPPED
+		rec.Detail = "PKGBUILD not changed and no error before"
+		LogInfo("skiped the build process of package " + pkg.ID() + ": PKGBUILD not changed and no error before")
+		return true
+	}
+	err = PrepareKeys(pkg, logFile)
+	if err != nil {
+		fail("can not prepare PGP keys for package "+pkg.ID(), err)
+		return true
+	}
+	err = BuildPkg(pkg, worker, logFile)
+	if err != nil {
+		fail("can not build package "+pkg.ID()+" properly", err)
+		return true
+	}
+	err = VerifyPkg(pkg, logFile)
+	if err != nil {
+		fail("package "+pkg.ID()+" failed verification", err)
+		return true
+	}
+	err = PostBuildOps(pkg, logFile)
+	if err != nil {
+		fail("can not finish post-build process of package "+pkg.ID(), err)
+		return true
+	}
+	rec.Result = RESULT_OK
+	okFile, err := os.Create(path.Join(PkgBuildingDir(pkg), FLG_FILE_NO_ERR_BEFORE))
+	if err != nil {
+		LogWarn("can not create build-ok flag file: " + err.Error())
+		return true
+	}
+	defer okFile.Close()
+	cnt, err := okFile.WriteString("DELETE THIS FILE IF YOU WANT TO REBUILD")
+	if err != nil {
+		LogWarn("can not write build-ok flag file" + err.Error())
+		return true
+	}
+	if Conf.DebugMode {
+		LogInfo("written " + strconv.Itoa(cnt) + " bytes to file \"" + path.Join(PkgBuildingDir(pkg), FLG_FILE_NO_ERR_BEFORE) + "\"")
+	}
+	LogInfo("the build process of " + pkg.ID() + " finished successfully")
+	return true
+}
+
+func buildAll(workers WorkerPool, stop chan struct{}) {
+	err := CheckSignKey()
+	if err != nil {
+		LogWarn("signing key is not usable, this round is skipped: " + err.Error())
+		return
+	}
+	CheckAUR()
+	CheckOfficial()
+	AutoPromote()
+	failedMasters := PrepareMasters()
+	if pending := PendingReviews(); len(pending) > 0 {
+		LogWarn(strconv.Itoa(len(pending)) + " PKGBUILD(s) awaiting review: " + strings.Join(pending, ", "))
+	}
 	for index := range Conf.Packages {
+		if !Queue.Enqueue(Conf.Packages[index].ID()) && Conf.DebugMode {
+			LogInfo("package " + Conf.Packages[index].ID() + " is already queued or running, will not enqueue it again")
+		}
+	}
+buildloop:
+	for _, job := range Queue.Waiting() {
 		select {
 		case <-stop:
 			LogInfo("building: graceful exit signal received, no new jobs will be created")
 			break buildloop
 		default:
+			pkg := PkgByID(job.Package)
+			if pkg == nil {
+				Queue.Finish(job.ID)
+				continue
+			}
+			if failedMasters[ChrootKey(pkg)] {
+				LogWarn("package " + pkg.ID() + " stays queued since its master chroot is not ready")
+				continue
+			}
 			JobsWg.Add(1)
-			limiter <- struct{}{}
+			worker := <-workers
+			if !Queue.Start(job.ID) {
+				workers <- worker
+				JobsWg.Done()
+				continue
+			}
 			go func() {
 				defer JobsWg.Done()
-				defer func() { <-limiter }()
-				LogInfo("will build package " + Conf.Packages[index].Name + "...")
-				logFile, changed, err := PreBuildPrepare(&Conf.Packages[index])
-				if err != nil {
-					LogWarn("can not start to build " + Conf.Packages[index].Name + ": " + err.Error())
-					return
-				}
-				if !changed && FileExists(path.Join(PkgBuildingDir(&Conf.Packages[index]), FLG_FILE_NO_ERR_BEFORE)) {
-					LogInfo("skiped the build process of package " + Conf.Packages[index].Name + ": PKGBUILD not changed and no error before")
-					return
-				}
-				err = BuildPkg(&Conf.Packages[index], logFile)
-				if err != nil {
-					LogWarn("can not build package " + Conf.Packages[index].Name + " properly: " + err.Error())
-					return
-				}
-				err = PostBuildOps(&Conf.Packages[index], logFile)
-				if err != nil {
-					LogWarn("can not finish post-build process of package " + Conf.Packages[index].Name + ": " + err.Error())
-					return
+				defer func() { workers <- worker }()
+				if runJob(pkg, worker) {
+					Queue.Finish(job.ID)
+				} else {
+					Queue.Requeue(job.ID)
 				}
-				okFile, err := os.Create(path.Join(PkgBuildingDir(&Conf.Packages[index]), FLG_FILE_NO_ERR_BEFORE))
-				if err != nil {
-					LogWarn("can not create build-ok flag file: " + err.Error())
-					return
-				}
-				defer okFile.Close()
-				cnt, err := okFile.WriteString("DELETE THIS FILE IF YOU WANT TO REBUILD")
-				if err != nil {
-					LogWarn("can not write build-ok flag file" + err.Error())
-					return
-				}
-				if Conf.DebugMode {
-					LogInfo("written " + strconv.Itoa(cnt) + " bytes to file \"" + path.Join(PkgBuildingDir(&Conf.Packages[index]), FLG_FILE_NO_ERR_BEFORE) + "\"")
-				}
-				LogInfo("the build process of " + Conf.Packages[index].Name + " finished successfully")
 			}()
 		}
 	}
 }
 
-func ticker(limiter chan struct{}, stop chan struct{}) {
+func ticker(workers WorkerPool, stop chan struct{}) {
 	tick := time.NewTicker(Conf.Schedule)
 	defer tick.Stop()
 tickerloop:
@@ -87,7 +183,7 @@ tickerloop:
 			tick.Stop()
 			break tickerloop
 		case <-tick.C:
-			buildAll(limiter, stop)
+			buildAll(workers, stop)
 		}
 	}
 }
@@ -102,11 +198,25 @@ func main() {
 		close(stop)
 	}()
 	getConf()
-	limiter := make(chan struct{}, Conf.WorkersCnt)
-	initWorkingDirs(limiter)
-	buildAll(limiter, stop)
-	ticker(limiter, stop)
+	if len(os.Args) > 2 {
+		RunCommand(os.Args[2:])
+		return
+	}
+	CheckPrivilege()
+	workers := NewWorkerPool(Conf.WorkersCnt)
+	initWorkingDirs()
+	LockWorkingDir()
+	InitKeysDir()
+	InitSigning()
+	Check(Queue.Load())
+	Queue.Recover()
+	CleanSnapshots()
+	StartPublisher()
+	go maintenanceTicker(stop)
+	buildAll(workers, stop)
+	ticker(workers, stop)
 	LogInfo("graceful exit: waiting existing jobs...")
 	JobsWg.Wait()
+	StopPublisher()
 	LogInfo("graceful exit: goodbye!")
 }
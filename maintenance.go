@@ -0,0 +1,195 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:34:15
+ * @LastEditTime: 2026-10-19 15:16:19
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/maintenance.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	FILE_MAINTENANCE string = "maintenance.json"
+	PKG_KEYRING      string = "archlinux-keyring"
+)
+
+// Result of the last maintenance of a master chroot, kept apart from the
+// build history of packages.
+type MaintenanceState struct {
+	Time   time.Time `json:"time"`
+	OK     bool      `json:"ok"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func maintenanceFile(key string) string {
+	return path.Join(MasterDir(key), FILE_MAINTENANCE)
+}
+
+func LoadMaintenance(key string) MaintenanceState {
+	var state MaintenanceState
+	data, err := os.ReadFile(maintenanceFile(key))
+	if err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func saveMaintenance(key string, state MaintenanceState) {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err == nil {
+		err = os.WriteFile(maintenanceFile(key), data, 0644)
+	}
+	if err != nil {
+		LogWarn("can not save maintenance state of master chroot \"" + key + "\": " + err.Error())
+	}
+}
+
+// Upgrade the master once per round, so no round builds against a stale
+// one. A failure is only reported, builds go on with the master as it is
+// and the maintenance deals with it when due.
+func upgradeMaster(key string) {
+	lockFile, err := Lock(path.Join(MasterDir(key), FILE_ROOT_LOCK))
+	if err == nil {
+		args := append(masterArgs(key), MasterRoot(key), BIN_PACMAN, "-Syu", "--noconfirm")
+		err = SudoRun(Conf.BuildUser, Conf.BuildGroup, MasterLogFile(key), BIN_ARCH_NSPAWN, args...)
+		Unlock(lockFile)
+	}
+	if err != nil {
+		LogWarn("can not upgrade master chroot \"" + key + "\", see " + MasterLogFile(key) + ": " + err.Error())
+	}
+}
+
+func MaintenanceDue(key string) bool {
+	last := LoadMaintenance(key).Time
+	return last.IsZero() || time.Since(last) >= Conf.ChrootMaintenance
+}
+
+// Refresh the keyring first, so the upgrade does not fail on packages
+// signed by new keys, then upgrade and clean the package cache. A leftover
+// pacman db lock is removed first since nothing else may run pacman in the
+// master while root.lock is held.
+func runMaintenance(key string) error {
+	lockFile, err := Lock(path.Join(MasterDir(key), FILE_ROOT_LOCK))
+	if err != nil {
+		return err
+	}
+	defer Unlock(lockFile)
+	nspawn := func(args ...string) error {
+		args = append(append(masterArgs(key), MasterRoot(key)), args...)
+		return SudoRun(Conf.BuildUser, Conf.BuildGroup, MasterLogFile(key), BIN_ARCH_NSPAWN, args...)
+	}
+	if FileExists(path.Join(MasterRoot(key), FILE_PACMAN_DBLCK)) {
+		LogWarn("removing leftover pacman db lock of master chroot \"" + key + "\"")
+		err = nspawn(BIN_RM, "-f", FILE_PACMAN_DBLCK)
+		if err != nil {
+			return err
+		}
+	}
+	err = nspawn(BIN_PACMAN, "-Sy", "--noconfirm", "--needed", PKG_KEYRING)
+	if err != nil {
+		return err
+	}
+	err = nspawn(BIN_PACMAN, "-Su", "--noconfirm")
+	if err != nil {
+		return err
+	}
+	return cleanMasterCache(key)
+}
+
+// The cache dir is ours, so its entries can be removed without root.
+func cleanMasterCache(key string) error {
+	entries, err := os.ReadDir(MasterCacheDir(key))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := os.RemoveAll(path.Join(MasterCacheDir(key), e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the maintenance and record its result. Failures are reported on their
+// own and builds go on with the master as it is, unless its keyring is
+// broken or it failed ChrootMaxFailures times in a row, then it is
+// recreated, and only an error of that is returned. Caller must hold the
+// chroot lock.
+func MaintainMaster(key string) error {
+	LogInfo("start to maintain master chroot \"" + key + "\"")
+	size := logSize(MasterLogFile(key))
+	err := runMaintenance(key)
+	if err == nil {
+		saveMaintenance(key, MaintenanceState{Time: time.Now(), OK: true})
+		resetChrootFailures(key)
+		LogInfo("successfully maintained master chroot \"" + key + "\"")
+		return nil
+	}
+	saveMaintenance(key, MaintenanceState{Time: time.Now(), OK: false, Detail: err.Error()})
+	LogWarn("maintenance of master chroot \"" + key + "\" failed, see " + MasterLogFile(key) + ": " + err.Error())
+	if hasKeyringError(logSince(MasterLogFile(key), size)) {
+		LogWarn("keyring of master chroot \"" + key + "\" is broken, will recreate it")
+		return rebuildMaster(key)
+	}
+	if cnt := countChrootFailure(key); cnt >= Conf.ChrootMaxFailures {
+		LogWarn("maintenance of master chroot \"" + key + "\" failed " + strconv.Itoa(cnt) + " time(s) in a row, will recreate it")
+		return rebuildMaster(key)
+	}
+	return nil
+}
+
+// Maintain the masters whose maintenance is due, independently of rounds.
+// Busy masters are left to the next round or tick.
+func maintainDue() {
+	if !mastersLock.TryLock() {
+		return
+	}
+	defer mastersLock.Unlock()
+	for _, key := range MasterKeys() {
+		if !DirExists(MasterRoot(key)) || !MaintenanceDue(key) {
+			continue
+		}
+		lockFile, err := tryLockMaster(key)
+		if err == ErrLocked {
+			continue
+		}
+		if err == nil {
+			err = MaintainMaster(key)
+			Unlock(lockFile)
+		}
+		if err != nil {
+			LogWarn("can not recreate master chroot \"" + key + "\", see " + MasterLogFile(key) + ": " + err.Error())
+		}
+	}
+}
+
+func maintenanceTicker(stop chan struct{}) {
+	tick := time.NewTicker(Conf.ChrootMaintenance)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			JobsWg.Add(1)
+			maintainDue()
+			JobsWg.Done()
+		}
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:22:11
+ * @LastEditTime: 2026-10-19 15:05:31
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/official.go
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DIR_SYNC_DB string = "sync-db"
+
+const LOG_FILE_SYNC_DB string = "sync-db.log"
+
+const CONF_PACMAN_DEFAULT string = "/etc/pacman.conf"
+
+const (
+	OFFICIAL_WARN   string = "warn"
+	OFFICIAL_STOP   string = "stop"
+	OFFICIAL_REMOVE string = "remove"
+)
+
+const EVENT_OFFICIAL string = "official"
+
+var (
+	officialLock  sync.Mutex
+	officialFound = make(map[string]string)
+)
+
+func SyncDBDir() string {
+	return path.Join(Conf.WorkingDir, DIR_SYNC_DB)
+}
+
+func officialPacmanConf() string {
+	if Conf.PacmanConf != "" {
+		return Conf.PacmanConf
+	}
+	return CONF_PACMAN_DEFAULT
+}
+
+// Sync a private copy of the sync databases, like checkupdates does, and
+// list "repo/pkgname" of every package in them, except our own repos.
+func listOfficialPkgs() (map[string]string, error) {
+	err := os.MkdirAll(path.Join(SyncDBDir(), "local"), os.ModePerm)
+	if err == nil {
+		err = ChownToBuildUser(SyncDBDir())
+	}
+	if err != nil {
+		return nil, err
+	}
+	logFile := path.Join(LogsDir(), LOG_FILE_SYNC_DB)
+	err = SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, BIN_FAKEROOT, "--",
+		BIN_PACMAN, "-Sy", "--dbpath", SyncDBDir(), "--config", officialPacmanConf(), "--logfile", os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	out, err := SudoOutput(Conf.BuildUser, Conf.BuildGroup, SyncDBDir(), logFile,
+		BIN_PACMAN, "-Sl", "--dbpath", SyncDBDir(), "--config", officialPacmanConf())
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || slices.ContainsFunc(TargetDBs(), func(db string) bool { return fields[0] == DBBaseName(db) }) {
+			continue
+		}
+		if _, ok := res[fields[1]]; !ok {
+			res[fields[1]] = fields[0] + "/" + fields[1]
+		}
+	}
+	return res, nil
+}
+
+// Names the package may appear as in the official repos: the section name,
+// and the pkgbase and pkgnames from the last .SRCINFO.
+func officialCandidates(pkg *Package) []string {
+	res := []string{pkg.Name}
+	if IsAURPkg(pkg) && !slices.Contains(res, AURPkgbase(pkg)) {
+		res = append(res, AURPkgbase(pkg))
+	}
+	srcinfo := LoadSrcinfo(pkg)
+	if srcinfo == nil {
+		return res
+	}
+	for _, name := range append([]string{srcinfo.Pkgbase}, srcinfo.Pkgnames...) {
+		if name != "" && !slices.Contains(res, name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Names the package provides, a -git package usually provides the name of
+// the official one, so they are only warned about.
+func officialProvides(pkg *Package) []string {
+	res := make([]string, 0)
+	srcinfo := LoadSrcinfo(pkg)
+	if srcinfo == nil {
+		return res
+	}
+	for _, name := range srcinfo.Provides {
+		if i := strings.IndexAny(name, "=<>"); i >= 0 {
+			name = name[:i]
+		}
+		if !slices.Contains(res, name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Entries in the database built from the package.
+func publishedNames(pkg *Package, db string) []string {
+	entries, err := ReadRepoDB(db)
+	if err != nil {
+		LogWarn("can not read database: " + err.Error())
+		return nil
+	}
+	res := make([]string, 0)
+	for name, entry := range entries {
+		if name == pkg.Name || entry.Base == pkg.Name || (IsAURPkg(pkg) && entry.Base == AURPkgbase(pkg)) {
+			res = append(res, name)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Check whether any configured package is now available from the official
+// repos, and act as configured.
+func CheckOfficial() {
+	official, err := listOfficialPkgs()
+	if err != nil {
+		LogWarn("can not list packages in official repos: " + err.Error())
+		return
+	}
+	found := make(map[string]string)
+	for i := range Conf.Packages {
+		pkg := &Conf.Packages[i]
+		for _, name := range officialCandidates(pkg) {
+			if where, ok := official[name]; ok {
+				found[pkg.Name] = where
+				break
+			}
+		}
+		where, ok := found[pkg.Name]
+		if !ok {
+			for _, name := range officialProvides(pkg) {
+				if where, ok := official[name]; ok && pkg.IsPrimary() {
+					LogWarn("package " + pkg.Name + " provides " + name + ", which is available from the official repos as " + where)
+					break
+				}
+			}
+			continue
+		}
+		if pkg.IsPrimary() {
+			LogWarn("package " + pkg.Name + " is now available from the official repos as " + where)
+		}
+		if pkg.OfficialAction != OFFICIAL_REMOVE {
+			continue
+		}
+		// Promoted copies must go as well.
+		for _, db := range PkgDBs(pkg) {
+			names := publishedNames(pkg, db)
+			if len(names) == 0 {
+				continue
+			}
+			err := Unpublish(pkg, db, names)
+			if err != nil {
+				LogWarn("can not remove package " + pkg.ID() + " from " + db + ": " + err.Error())
+				continue
+			}
+			AppendHistory(&BuildRecord{Time: time.Now(), Package: pkg.ID(), Event: EVENT_OFFICIAL, Result: RESULT_OK,
+				Detail: "removed " + strings.Join(names, ", ") + " from " + db + " since it is available as " + where})
+		}
+	}
+	officialLock.Lock()
+	officialFound = found
+	officialLock.Unlock()
+}
+
+// Where the package was found in the official repos if it should not be
+// built any more, empty otherwise.
+func OfficialStop(pkg *Package) string {
+	if pkg.OfficialAction == OFFICIAL_WARN {
+		return ""
+	}
+	officialLock.Lock()
+	defer officialLock.Unlock()
+	return officialFound[pkg.Name]
+}
@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-07-28 23:18:36
- * @LastEditTime: 2025-08-03 20:57:16
+ * @LastEditTime: 2026-10-19 15:12:44
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /repo-donkey/os.go
@@ -15,12 +15,14 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"strconv"
 	"strings"
 )
 
 const (
 	BIN_SUDO          string = "/usr/bin/sudo"
+	BIN_RM            string = "/usr/bin/rm"
 	BIN_BASH          string = "/usr/bin/bash"
 	BIN_MKARCHROOT    string = "/usr/bin/mkarchroot"
 	BIN_ARCH_NSPAWN   string = "/usr/bin/arch-nspawn"
@@ -28,6 +30,12 @@ const (
 	BIN_MAKECHROOTPKG string = "/usr/bin/makechrootpkg"
 	BIN_GPG           string = "/usr/bin/gpg"
 	BIN_REPO_ADD      string = "/usr/bin/repo-add"
+	BIN_REPO_REMOVE   string = "/usr/bin/repo-remove"
+	BIN_MAKEPKG       string = "/usr/bin/makepkg"
+	BIN_BSDTAR        string = "/usr/bin/bsdtar"
+	BIN_NAMCAP        string = "/usr/bin/namcap"
+	BIN_DIFF          string = "/usr/bin/diff"
+	BIN_FAKEROOT      string = "/usr/bin/fakeroot"
 	CONF_MAKEPKG      string = "etc/makepkg.conf"
 	CONF_PACMAN       string = "etc/pacman.conf"
 	SUFFIX_PKG        string = ".pkg.tar.zst"
@@ -71,6 +79,44 @@ func CopyAndOverwrite(dst, src string) error {
 	return nil
 }
 
+// Hard link the file if possible, the staging dir is usually on the same
+// filesystem as the source, copy it otherwise.
+func LinkOrCopy(dst, src string) error {
+	err := os.Remove(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return CopyAndOverwrite(dst, src)
+}
+
+// Give the file to the build user, only possible (and needed) when running
+// as root.
+func ChownToBuildUser(name string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	u, err := user.Lookup(Conf.BuildUser)
+	if err != nil {
+		return err
+	}
+	g, err := user.LookupGroup(Conf.BuildGroup)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(name, uid, gid)
+}
+
 func PanicOnErr[T any](some T, err error) T {
 	if err != nil {
 		LogError(err.Error())
@@ -98,12 +144,33 @@ func FileContentIs(name string, content []byte) (bool, error) {
 	return bytes.Equal(file, content), nil
 }
 
+// Whether repo-donkey itself runs as the user, commands for the user need no
+// sudo then.
+func IsCurrentUser(name string) bool {
+	cur, err := user.Current()
+	return err == nil && cur.Username == name
+}
+
 func SudoRun(asUser string, asGroup string, logTo string, name string, args ...string) error {
-	toRun := make([]string, 0)
-	toRun = append(toRun, BIN_SUDO, "-u", asUser, "-g", asGroup, name)
-	toRun = append(toRun, args...)
-	cmd := exec.Command(toRun[0], toRun[1:]...)
-	return RunWithLog(cmd, toRun, logTo)
+	cmd := ExtCmd{Argv: append([]string{name}, args...), User: asUser, Group: asGroup}
+	return cmd.Run(logTo)
+}
+
+// Run the command as the user in the dir and return its stdout, stderr goes
+// to the log file.
+func SudoOutput(asUser string, asGroup string, dir string, logTo string, name string, args ...string) ([]byte, error) {
+	cmd := ExtCmd{Argv: append([]string{name}, args...), Dir: dir, User: asUser, Group: asGroup}
+	return cmd.Output(logTo)
+}
+
+func AppendToFile(name string, content []byte) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(content)
+	return err
 }
 
 func RunWithLog(cmd *exec.Cmd, toRun []string, logTo string) error {
@@ -116,15 +183,18 @@ func RunWithLog(cmd *exec.Cmd, toRun []string, logTo string) error {
 			return err
 		}
 		defer logFile.Close()
-		var logWritter io.Writer
+		// Flushed before the file is closed, callers read the log afterwards.
+		buffered := bufio.NewWriter(logFile)
+		defer buffered.Flush()
+		var logWritter io.Writer = buffered
 		if Conf.DebugMode {
 			cmd.Stdin = os.Stdin
-			logWritter = io.MultiWriter(bufio.NewWriter(logFile), os.Stdout)
-		} else {
-			logWritter = bufio.NewWriter(logFile)
+			logWritter = io.MultiWriter(buffered, os.Stdout)
 		}
 		cmd.Stderr = logWritter
-		cmd.Stdout = logWritter
+		if cmd.Stdout == nil {
+			cmd.Stdout = logWritter
+		}
 	}
 	err := cmd.Run()
 	if Conf.DebugMode {
@@ -0,0 +1,380 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:28:04
+ * @LastEditTime: 2026-10-19 15:14:45
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/privilege.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+const CMD_PRIVILEGED string = "privileged"
+
+// Tools of devtools which must run as root. Without root, they are run
+// through "sudo repo-donkey <config> privileged", which only accepts the
+// arguments repo-donkey itself uses.
+var PrivilegedTools = []string{BIN_MKARCHROOT, BIN_ARCH_NSPAWN, BIN_MAKECHROOTPKG}
+
+var (
+	pkgNameRegexp    = regexp.MustCompile(`^[a-z0-9@_+][a-z0-9@._+-]*$`)
+	chrootCopyRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+)
+
+func Rootless() bool {
+	return os.Geteuid() != 0
+}
+
+// Without root, we can not switch to another user, so repo-donkey must be
+// started as the build user. Everything the privileged helper reads as
+// root must not be writable by it.
+func CheckPrivilege() {
+	if !Rootless() {
+		return
+	}
+	if !IsCurrentUser(Conf.BuildUser) {
+		LogError("not running as root, so repo-donkey must be started as the build user \"" + Conf.BuildUser + "\"")
+	}
+	for _, file := range append([]string{configPath(), selfPath()}, chrootConfs()...) {
+		err := checkRootOwned(file)
+		if err != nil {
+			LogError("not running as root, but " + err.Error())
+		}
+	}
+}
+
+func selfPath() string {
+	self, err := os.Executable()
+	Check(err)
+	self, err = filepath.EvalSymlinks(self)
+	Check(err)
+	return self
+}
+
+func configPath() string {
+	conf, err := filepath.Abs(os.Args[1])
+	Check(err)
+	return conf
+}
+
+// Whether this process is the privileged helper run by sudo.
+func privilegedRun() bool {
+	return len(os.Args) > 2 && os.Args[2] == CMD_PRIVILEGED
+}
+
+// pacman.conf and makepkg.conf files passed to devtools, for a generated
+// makepkg.conf the files it is made of.
+func chrootConfs() []string {
+	res := make([]string, 0)
+	for i := range Conf.Packages {
+		pkg := &Conf.Packages[i]
+		confs := []string{pkg.PacmanConf, pkg.MakepkgConf}
+		if len(pkg.MakepkgConfParts) > 0 {
+			confs = append([]string{pkg.PacmanConf}, pkg.MakepkgConfParts...)
+		}
+		for _, conf := range confs {
+			if conf != "" && !slices.Contains(res, conf) {
+				res = append(res, conf)
+			}
+		}
+	}
+	return res
+}
+
+// A regular file in a dir, both owned by root and writable only by root.
+func checkRootOwned(file string) error {
+	for _, p := range []string{file, filepath.Dir(file)} {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if (p == file) != info.Mode().IsRegular() || !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+			return errors.New("\"" + file + "\" and its dir must be owned by root and writable only by root")
+		}
+	}
+	return nil
+}
+
+// Argv which runs the privileged tool through the helper.
+func privilegedArgv(argv []string) []string {
+	return append([]string{BIN_SUDO, "-n", selfPath(), configPath(), CMD_PRIVILEGED}, argv...)
+}
+
+// Sudoers rules which allow the build user to run only the helper as root,
+// with the config pinned, and without keeping any env var.
+func SudoersRules() string {
+	escape := strings.NewReplacer("\\", "\\\\", ",", "\\,", ":", "\\:", "=", "\\=", " ", "\\ ")
+	lines := []string{
+		"# Sudoers rules for repo-donkey",
+		"Cmnd_Alias REPO_DONKEY_HELPER = " + escape.Replace(selfPath()) + " " + escape.Replace(configPath()) + " " + CMD_PRIVILEGED + " *",
+		Conf.BuildUser + " ALL=(root) NOPASSWD: REPO_DONKEY_HELPER",
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A path of a master chroot, its root or cache, without symlinks below the
+// working dir.
+func checkChrootPath(p string) error {
+	rel, err := filepath.Rel(ChrootsDir(), p)
+	if err != nil || p != filepath.Clean(p) || !filepath.IsAbs(p) || rel == "." || strings.HasPrefix(rel, "..") {
+		return errors.New("\"" + p + "\" is not in \"" + ChrootsDir() + "\"")
+	}
+	rel, err = filepath.Rel(Conf.WorkingDir, p)
+	Check(err)
+	cur := Conf.WorkingDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("\"" + cur + "\" is a symlink")
+		}
+	}
+	return nil
+}
+
+// Parse the -C, -M and -c options mkarchroot and arch-nspawn take, returns
+// the rest.
+func checkChrootOpts(args []string) ([]string, error) {
+	for len(args) >= 2 {
+		var err error
+		switch args[0] {
+		case "-C", "-M":
+			if parts := generatedConfParts(args[0], args[1]); parts != nil {
+				err = checkRootOwnedAll(parts)
+				break
+			}
+			if !slices.Contains(chrootConfs(), args[1]) {
+				return nil, errors.New("\"" + args[1] + "\" is not a configured pacman.conf or makepkg.conf")
+			}
+			err = checkRootOwned(args[1])
+		case "-c":
+			err = checkChrootPath(args[1])
+		default:
+			return args, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = args[2:]
+	}
+	return args, nil
+}
+
+func checkRootOwnedAll(files []string) error {
+	for _, file := range files {
+		err := checkRootOwned(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The parts of the generated makepkg.conf given with -M, nil if it is not
+// one. The build user can write the generated file, so it is never used as
+// root.
+func generatedConfParts(opt string, file string) []string {
+	if opt != "-M" {
+		return nil
+	}
+	for i := range Conf.Packages {
+		if len(Conf.Packages[i].MakepkgConfParts) > 0 && Conf.Packages[i].MakepkgConf == file {
+			return Conf.Packages[i].MakepkgConfParts
+		}
+	}
+	return nil
+}
+
+// Replace generated makepkg.conf files in the checked argv with copies made
+// by root from their parts, returns the new argv and the copies to remove.
+func privateMakepkgConfs(argv []string) ([]string, []string, error) {
+	res := slices.Clone(argv)
+	tmps := make([]string, 0)
+	for i := 1; i+1 < len(res); i++ {
+		parts := generatedConfParts(res[i], res[i+1])
+		if parts == nil {
+			continue
+		}
+		content, err := makepkgConfContent(parts)
+		if err != nil {
+			return nil, tmps, err
+		}
+		// Created exclusively by root in the sticky temp dir, nobody else
+		// can replace it.
+		tmp, err := os.CreateTemp("", "repo-donkey-makepkg-*.conf")
+		if err != nil {
+			return nil, tmps, err
+		}
+		tmps = append(tmps, tmp.Name())
+		_, err = tmp.Write(content)
+		if err == nil {
+			err = tmp.Chmod(0644)
+		}
+		tmp.Close()
+		if err != nil {
+			return nil, tmps, err
+		}
+		res[i+1] = tmp.Name()
+	}
+	return res, tmps, nil
+}
+
+func checkPkgNames(names []string) error {
+	for _, name := range names {
+		if !pkgNameRegexp.MatchString(name) {
+			return errors.New("invalid package name \"" + name + "\"")
+		}
+	}
+	return nil
+}
+
+// What may run in a master chroot: pacman to install and upgrade packages,
+// and removing a leftover pacman db lock.
+func checkNspawnCmd(argv []string) error {
+	if slices.Equal(argv, []string{BIN_RM, "-f", FILE_PACMAN_DBLCK}) {
+		return nil
+	}
+	if len(argv) < 2 || argv[0] != BIN_PACMAN || !slices.Contains([]string{"-Sy", "-Su", "-Syu"}, argv[1]) {
+		return errors.New("command not allowed in chroot")
+	}
+	names := make([]string, 0)
+	for _, arg := range argv[2:] {
+		if arg != "--noconfirm" && arg != "--needed" {
+			names = append(names, arg)
+		}
+	}
+	return checkPkgNames(names)
+}
+
+func checkMakechrootpkgArgs(args []string) error {
+	hasRoot, hasCopy := false, false
+	for len(args) > 0 && args[0] != "--" {
+		switch {
+		case args[0] == "-c" || args[0] == "-T" || args[0] == "-n":
+			args = args[1:]
+			continue
+		case args[0] == "-r" && len(args) > 1:
+			err := checkChrootPath(args[1])
+			if err != nil {
+				return err
+			}
+			hasRoot = true
+		case args[0] == "-l" && len(args) > 1:
+			if !chrootCopyRegexp.MatchString(args[1]) {
+				return errors.New("invalid chroot copy name \"" + args[1] + "\"")
+			}
+			hasCopy = true
+		default:
+			return errors.New("option \"" + args[0] + "\" not allowed")
+		}
+		args = args[2:]
+	}
+	if !hasRoot || !hasCopy {
+		return errors.New("-r and -l are required")
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	for _, arg := range args[1:] {
+		name, _, found := strings.Cut(arg, "=")
+		if arg != "--nocheck" && (!found || !envNameRegexp.MatchString(name)) {
+			return errors.New("makepkg argument \"" + arg + "\" not allowed")
+		}
+	}
+	return nil
+}
+
+// Check the arguments of a privileged tool have the shape repo-donkey
+// uses, nothing else may run as root.
+func checkPrivilegedArgv(argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no tool given")
+	}
+	switch argv[0] {
+	case BIN_MKARCHROOT:
+		rest, err := checkChrootOpts(argv[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 2 {
+			return errors.New("chroot and packages expected")
+		}
+		if FileExists(rest[0]) || DirExists(rest[0]) {
+			return errors.New("\"" + rest[0] + "\" already exists")
+		}
+		err = checkChrootPath(rest[0])
+		if err != nil {
+			return err
+		}
+		return checkPkgNames(rest[1:])
+	case BIN_ARCH_NSPAWN:
+		rest, err := checkChrootOpts(argv[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 2 {
+			return errors.New("chroot and command expected")
+		}
+		err = checkChrootPath(rest[0])
+		if err != nil {
+			return err
+		}
+		return checkNspawnCmd(rest[1:])
+	case BIN_MAKECHROOTPKG:
+		return checkMakechrootpkgArgs(argv[1:])
+	}
+	return errors.New("\"" + argv[0] + "\" is not a privileged tool")
+}
+
+// Run by sudo as root: check the config can only be changed by root, check
+// the arguments, then run the tool with private copies of generated confs
+// and exit with its status.
+func RunPrivileged(argv []string) {
+	if os.Geteuid() != 0 {
+		LogError(CMD_PRIVILEGED + " must be run as root through sudo")
+	}
+	for _, file := range []string{configPath(), selfPath()} {
+		Check(checkRootOwned(file))
+	}
+	err := checkPrivilegedArgv(argv)
+	if err != nil {
+		LogError("refused to run " + strings.Join(argv, " ") + ": " + err.Error())
+	}
+	toRun, tmps, err := privateMakepkgConfs(argv)
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	Check(err)
+	cmd := exec.Command(toRun[0], toRun[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+		os.Exit(exitErr.ExitCode())
+	}
+	Check(err)
+}
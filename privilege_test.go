@@ -0,0 +1,125 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 15:00:10
+ * @LastEditTime: 2026-10-19 15:14:45
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/privilege_test.go
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheckPrivilegedArgv(t *testing.T) {
+	Conf.WorkingDir = t.TempDir()
+	c := ChrootsDir()
+	cases := []struct {
+		name string
+		argv []string
+		ok   bool
+	}{
+		{"mkarchroot", []string{BIN_MKARCHROOT, "-c", c + "/k/cache", c + "/k/root", "base-devel"}, true},
+		{"mkarchroot outside", []string{BIN_MKARCHROOT, c + "/../x", "base-devel"}, false},
+		{"mkarchroot option as pkg", []string{BIN_MKARCHROOT, c + "/k/root", "-f"}, false},
+		{"pacman", []string{BIN_ARCH_NSPAWN, c + "/k/root", BIN_PACMAN, "-Syu", "--noconfirm", "--needed", "foo"}, true},
+		{"pacman option", []string{BIN_ARCH_NSPAWN, c + "/k/root", BIN_PACMAN, "-Syu", "--root=/"}, false},
+		{"rm db lock", []string{BIN_ARCH_NSPAWN, c + "/k/root", BIN_RM, "-f", FILE_PACMAN_DBLCK}, true},
+		{"shell", []string{BIN_ARCH_NSPAWN, c + "/k/root", "/bin/sh"}, false},
+		{"makechrootpkg", []string{BIN_MAKECHROOTPKG, "-c", "-r", c + "/k", "-l", "worker-1", "--", "--nocheck", "FOO=a b"}, true},
+		{"copy outside", []string{BIN_MAKECHROOTPKG, "-r", c + "/k", "-l", "../x"}, false},
+		{"bind mount", []string{BIN_MAKECHROOTPKG, "-r", c + "/k", "-l", "w", "-D", "/:/x"}, false},
+		{"makepkg option", []string{BIN_MAKECHROOTPKG, "-r", c + "/k", "-l", "w", "--", "--install"}, false},
+		{"other tool", []string{"/bin/sh", "-c", "id"}, false},
+	}
+	for _, tc := range cases {
+		err := checkPrivilegedArgv(tc.argv)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+	if err := os.MkdirAll(c, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(c, "k")); err != nil {
+		t.Fatal(err)
+	}
+	if checkChrootPath(c+"/k/root") == nil {
+		t.Error("symlink in chroot path accepted")
+	}
+}
+
+// Without root, a package with MakepkgConfAppend is checked by the files its
+// makepkg.conf is made of, and the helper never uses the generated file.
+func TestRootlessMakepkgConfAppend(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("files owned by root are needed")
+	}
+	confDir := t.TempDir()
+	base := filepath.Join(confDir, "makepkg.conf")
+	snippet := filepath.Join(confDir, "v3.conf")
+	if err := os.WriteFile(base, []byte("BASE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(snippet, []byte("SNIPPET\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Conf.WorkingDir = t.TempDir()
+	pkg := Package{Name: "foo", Variant: "v3", MakepkgConf: base}
+	pkg.MakepkgConf = genMakepkgConf(&pkg, []string{snippet})
+	Conf.Packages = []Package{pkg}
+	defer func() { Conf.Packages = nil }()
+
+	// The generated file belongs to the build user.
+	if err := os.Chown(pkg.MakepkgConf, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if checkRootOwned(pkg.MakepkgConf) == nil {
+		t.Fatal("generated makepkg.conf accepted as root-owned")
+	}
+	if confs := chrootConfs(); !slices.Equal(confs, []string{base, snippet}) {
+		t.Fatalf("chroot confs: got %v", confs)
+	}
+	if err := checkRootOwnedAll(chrootConfs()); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(ChrootsDir(), "k", "root")
+	argv := []string{BIN_ARCH_NSPAWN, "-M", pkg.MakepkgConf, root, BIN_PACMAN, "-Syu", "--noconfirm"}
+	if err := checkPrivilegedArgv(argv); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pkg.MakepkgConf, []byte("TAMPERED\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	toRun, tmps, err := privateMakepkgConfs(argv)
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) != 1 || toRun[2] != tmps[0] {
+		t.Fatalf("generated makepkg.conf not replaced: %v", toRun)
+	}
+	want, _ := makepkgConfContent([]string{base, snippet})
+	if got, _ := os.ReadFile(tmps[0]); string(got) != string(want) {
+		t.Errorf("private makepkg.conf: got %q, want %q", got, want)
+	}
+
+	// The helper only computes the path.
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"repo-donkey", "x.conf", CMD_PRIVILEGED}
+	other := Package{Name: "bar", MakepkgConf: base}
+	if FileExists(genMakepkgConf(&other, []string{snippet})) {
+		t.Error("privileged helper wrote a generated makepkg.conf")
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:44:55
+ * @LastEditTime: 2026-10-19 14:45:28
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/promote.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const DIR_HOLDS string = "holds"
+
+const EVENT_PROMOTE string = "promote"
+
+func HoldsDir() string {
+	return path.Join(Conf.WorkingDir, DIR_HOLDS)
+}
+
+func PkgHoldFile(pkgID string) string {
+	return path.Join(HoldsDir(), pkgID)
+}
+
+// Why the package should not be promoted automatically, empty if it is
+// not held.
+func HoldReason(pkgID string) string {
+	content, err := os.ReadFile(PkgHoldFile(pkgID))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func Hold(pkgID string, reason string) error {
+	err := os.MkdirAll(HoldsDir(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(PkgHoldFile(pkgID), []byte(reason+"\n"), 0644)
+}
+
+func Unhold(pkgID string) error {
+	err := os.Remove(PkgHoldFile(pkgID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Repos of the package which promote to another one.
+func promotingRepos(pkg *Package) []*Repo {
+	res := make([]*Repo, 0)
+	for _, name := range pkg.Repos {
+		if r := RepoByName(name); r.PromoteTo != "" {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// When the package was built and published successfully the last time, zero
+// if it never was.
+func lastPublished(pkg *Package) time.Time {
+	records, err := ReadHistory(pkg.ID())
+	if err != nil {
+		LogWarn("can not read history of package " + pkg.ID() + ": " + err.Error())
+		return time.Time{}
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Event == EVENT_BUILD && records[i].Result == RESULT_OK {
+			return records[i].Time
+		}
+	}
+	return time.Time{}
+}
+
+// Lock the databases in a fixed order, so two promotions can never wait for
+// each other.
+func lockDBs(dbs ...string) ([]*os.File, error) {
+	slices.Sort(dbs)
+	res := make([]*os.File, 0, len(dbs))
+	for _, db := range dbs {
+		file, err := Lock(db + SUFFIX_DB_LOCK)
+		if err != nil {
+			unlockDBs(res)
+			return nil, err
+		}
+		res = append(res, file)
+	}
+	return res, nil
+}
+
+func unlockDBs(files []*os.File) {
+	for _, file := range files {
+		Unlock(file)
+	}
+}
+
+// Add the archives (and their signatures) in the repo dir of another
+// database to the database. Signatures which do not verify with the keys of
+// the repo are made again.
+func addExisting(db string, archives []string) error {
+	repo := RepoOf(db)
+	before, err := ReadRepoDB(db)
+	if err != nil {
+		return err
+	}
+	staging, err := NewStaging(db)
+	if err != nil {
+		return err
+	}
+	defer staging.Cleanup()
+	staged := make([]string, 0, len(archives))
+	for _, archive := range archives {
+		stagedArchive, err := staging.AddArchive(archive)
+		if err != nil {
+			return err
+		}
+		if len(repo.SignKeys) > 0 && VerifySig(stagedArchive, repo.SignKeys, PublishLogFile()) != nil {
+			os.Remove(stagedArchive + ".sig")
+			err = SignFile(stagedArchive, repo.SignKeys, PublishLogFile())
+			if err != nil {
+				return err
+			}
+		}
+		staged = append(staged, stagedArchive)
+	}
+	err = repoAdd(staging.DBPath(), staged)
+	if err != nil {
+		return err
+	}
+	return swapStaged(staging, staged, before)
+}
+
+func removeExisting(db string, names []string) error {
+	before, err := ReadRepoDB(db)
+	if err != nil {
+		return err
+	}
+	staging, err := NewStaging(db)
+	if err != nil {
+		return err
+	}
+	defer staging.Cleanup()
+	err = repoRemove(staging.DBPath(), names)
+	if err != nil {
+		return err
+	}
+	return swapStaged(staging, nil, before)
+}
+
+// Sign the staged database if the repo is signed, swap it in and remove
+// what was replaced.
+func swapStaged(staging *Staging, archives []string, before map[string]RepoDBEntry) error {
+	repo := RepoOf(staging.DB)
+	if len(repo.SignKeys) > 0 {
+		err := SignStagedDB(staging)
+		if err != nil {
+			return err
+		}
+	}
+	err := staging.Swap(archives)
+	if err != nil {
+		return err
+	}
+	after, err := ReadRepoDB(staging.DB)
+	if err != nil {
+		LogWarn("can not read database to remove replaced archives: " + err.Error())
+		return nil
+	}
+	PruneReplaced(staging.DB, before, after, repo.Keep)
+	return nil
+}
+
+// Move the published archives of the package from the repo to the one it
+// promotes to. The archives are added to the target first, so they are
+// never missing from both.
+func promoteFrom(pkg *Package, from *Repo) error {
+	to := RepoByName(from.PromoteTo)
+	src, dst := from.DB(pkg.Variant), to.DB(pkg.Variant)
+	if dst == "" {
+		return errors.New("repo " + to.Name + " has no database for variant " + pkg.Variant)
+	}
+	locks, err := lockDBs(src, dst)
+	if err != nil {
+		return err
+	}
+	defer unlockDBs(locks)
+	entries, err := ReadRepoDB(src)
+	if err != nil {
+		return err
+	}
+	names := publishedNames(pkg, src)
+	if len(names) == 0 {
+		return errors.New("package " + pkg.ID() + " is not in " + src)
+	}
+	archives := make([]string, 0, len(names))
+	versions := make([]string, 0, len(names))
+	for _, name := range names {
+		archives = append(archives, path.Join(RepoDir(src), entries[name].Filename))
+		versions = append(versions, name+" "+entries[name].Version)
+	}
+	LogInfo("promoting " + strings.Join(versions, ", ") + " from " + src + " to " + dst)
+	rec := &BuildRecord{Time: time.Now(), Package: pkg.ID(), Event: EVENT_PROMOTE, Result: RESULT_FAILED}
+	defer AppendHistory(rec)
+	err = addExisting(dst, archives)
+	if err != nil {
+		rec.Detail = "can not add to " + to.Name + ": " + err.Error()
+		return errors.New(rec.Detail)
+	}
+	err = removeExisting(src, names)
+	if err != nil {
+		rec.Detail = "added to " + to.Name + " but can not remove from " + from.Name + ": " + err.Error()
+		return errors.New(rec.Detail)
+	}
+	rec.Result = RESULT_OK
+	rec.Detail = "promoted " + strings.Join(versions, ", ") + " from " + from.Name + " to " + to.Name
+	return nil
+}
+
+// Promote the package from every repo of it which promotes to another one.
+func Promote(pkg *Package) error {
+	repos := promotingRepos(pkg)
+	if len(repos) == 0 {
+		return errors.New("package " + pkg.ID() + " is not in a repo with \"" + KEY_PROMOTE_TO + "\"")
+	}
+	for _, r := range repos {
+		err := promoteFrom(pkg, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Promote packages which were published long enough ago and are not held.
+func AutoPromote() {
+	for i := range Conf.Packages {
+		pkg := &Conf.Packages[i]
+		for _, r := range promotingRepos(pkg) {
+			if r.SoakTime <= 0 || len(publishedNames(pkg, r.DB(pkg.Variant))) == 0 {
+				continue
+			}
+			if reason := HoldReason(pkg.ID()); reason != "" {
+				if Conf.DebugMode {
+					LogInfo("package " + pkg.ID() + " is held in " + r.Name + ": " + reason)
+				}
+				continue
+			}
+			published := lastPublished(pkg)
+			if published.IsZero() || time.Since(published) < r.SoakTime {
+				continue
+			}
+			err := promoteFrom(pkg, r)
+			if err != nil {
+				LogWarn("can not promote package " + pkg.ID() + ": " + err.Error())
+				continue
+			}
+			LogInfo("package " + pkg.ID() + " promoted from " + r.Name + " to " + r.PromoteTo)
+		}
+	}
+}
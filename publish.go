@@ -0,0 +1,327 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:15:16
+ * @LastEditTime: 2026-10-19 14:43:54
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/publish.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LOG_FILE_PUBLISH string = "publish.log"
+
+const SUFFIX_DB_LOCK string = ".donkey-lock"
+
+// How long the publisher waits for other workers to finish before it
+// starts to process a batch.
+const PUBLISH_BATCH_WAIT time.Duration = 3 * time.Second
+
+type PublishRequest struct {
+	Pkg      *Package
+	DB       string
+	Archives []string
+	Remove   []string
+	result   chan error
+	staged   []string
+	err      error
+}
+
+type Publisher struct {
+	requests chan *PublishRequest
+	done     chan struct{}
+}
+
+var Pub Publisher
+
+func PublishLogFile() string {
+	return path.Join(LogsDir(), LOG_FILE_PUBLISH)
+}
+
+func StartPublisher() {
+	Pub.requests = make(chan *PublishRequest, Conf.WorkersCnt)
+	Pub.done = make(chan struct{})
+	go Pub.loop()
+}
+
+// Stop accepting requests and wait for the last batch to be published.
+func StopPublisher() {
+	close(Pub.requests)
+	<-Pub.done
+}
+
+// Hand the archives (paths in the building dir) to the publisher and wait
+// until they are in every target database of the package. The archives are
+// kept if any of them failed, so the next round can try again.
+func Publish(pkg *Package, archives []string) error {
+	reqs := make([]*PublishRequest, 0, len(pkg.TargetDBs))
+	for _, db := range pkg.TargetDBs {
+		req := &PublishRequest{Pkg: pkg, DB: db, Archives: archives, result: make(chan error, 1)}
+		Pub.requests <- req
+		reqs = append(reqs, req)
+	}
+	errs := make([]error, 0)
+	for _, req := range reqs {
+		errs = append(errs, <-req.result)
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+	for _, archive := range archives {
+		for _, file := range []string{archive, archive + ".sig"} {
+			err := os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				LogWarn("can not remove published file \"" + file + "\": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Let the publisher remove the packages from the database, their archives
+// are removed from the repo dir as well.
+func Unpublish(pkg *Package, db string, names []string) error {
+	req := &PublishRequest{Pkg: pkg, DB: db, Remove: names, result: make(chan error, 1)}
+	Pub.requests <- req
+	return <-req.result
+}
+
+func (p *Publisher) loop() {
+	defer close(p.done)
+	for req := range p.requests {
+		batch := []*PublishRequest{req}
+		timeout := time.After(PUBLISH_BATCH_WAIT)
+	collect:
+		for {
+			select {
+			case more, ok := <-p.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, more)
+			case <-timeout:
+				break collect
+			}
+		}
+		// Each database is locked, staged and swapped on its own.
+		dbs := make([]string, 0)
+		for _, req := range batch {
+			if !slices.Contains(dbs, req.DB) {
+				dbs = append(dbs, req.DB)
+			}
+		}
+		for _, db := range dbs {
+			publishBatch(db, slices.DeleteFunc(slices.Clone(batch), func(req *PublishRequest) bool { return req.DB != db }))
+		}
+	}
+}
+
+func repoAdd(db string, archives []string) error {
+	args := append([]string{db}, archives...)
+	return SudoRun(Conf.BuildUser, Conf.BuildGroup, PublishLogFile(), BIN_REPO_ADD, args...)
+}
+
+func repoRemove(db string, names []string) error {
+	args := append([]string{db}, names...)
+	return SudoRun(Conf.BuildUser, Conf.BuildGroup, PublishLogFile(), BIN_REPO_REMOVE, args...)
+}
+
+func failBatch(batch []*PublishRequest, err error) {
+	for _, req := range batch {
+		req.result <- err
+	}
+}
+
+// Add all archives of the batch with one repo-add call, if it fails, fall
+// back to one call per package to find out which one is broken.
+func addBatch(staging *Staging, batch []*PublishRequest) {
+	names := make([]string, 0)
+	archives := make([]string, 0)
+	adds := make([]*PublishRequest, 0)
+	for _, req := range batch {
+		if req.err == nil && len(req.staged) > 0 {
+			adds = append(adds, req)
+			names = append(names, req.Pkg.ID())
+			archives = append(archives, req.staged...)
+		}
+	}
+	if len(adds) == 0 {
+		return
+	}
+	LogInfo("publishing " + strconv.Itoa(len(archives)) + " archive(s) of " + strings.Join(names, ", ") + " to " + staging.DB)
+	err := repoAdd(staging.DBPath(), archives)
+	for _, req := range adds {
+		req.err = err
+		if err != nil && len(adds) > 1 {
+			req.err = repoAdd(staging.DBPath(), req.staged)
+		}
+	}
+}
+
+// Apply the batch to a staged copy of the database, only the requests which
+// succeeded are swapped into the repo. Archives are signed in the staging
+// dir with the keys of the repo, so one build can go to repos with
+// different keys.
+func publishBatch(db string, batch []*PublishRequest) {
+	repo := RepoOf(db)
+	dbLock, err := Lock(db + SUFFIX_DB_LOCK)
+	if err != nil {
+		failBatch(batch, err)
+		return
+	}
+	defer Unlock(dbLock)
+	before, err := ReadRepoDB(db)
+	if err != nil {
+		failBatch(batch, err)
+		return
+	}
+	staging, err := NewStaging(db)
+	if err != nil {
+		failBatch(batch, err)
+		return
+	}
+	defer staging.Cleanup()
+	for _, req := range batch {
+		for _, archive := range req.Archives {
+			stagedArchive, err := staging.AddArchive(archive)
+			if err != nil {
+				req.err = err
+				break
+			}
+			if len(repo.SignKeys) > 0 {
+				os.Remove(stagedArchive + ".sig")
+				err = SignFile(stagedArchive, repo.SignKeys, PublishLogFile())
+				if err != nil {
+					req.err = err
+					break
+				}
+			}
+			req.staged = append(req.staged, stagedArchive)
+		}
+	}
+	addBatch(staging, batch)
+	for _, req := range batch {
+		if req.err == nil && len(req.Remove) > 0 {
+			LogInfo("removing " + strings.Join(req.Remove, ", ") + " from " + db)
+			req.err = repoRemove(staging.DBPath(), req.Remove)
+		}
+	}
+	published := make([]string, 0)
+	changed := false
+	for _, req := range batch {
+		if req.err == nil {
+			published = append(published, req.staged...)
+			changed = true
+		}
+	}
+	if changed && len(repo.SignKeys) > 0 {
+		err = SignStagedDB(staging)
+		if err != nil {
+			LogWarn("can not sign staged database of " + db + ": " + err.Error())
+			changed = false
+			for _, req := range batch {
+				if req.err == nil {
+					req.err = err
+				}
+			}
+		}
+	}
+	if changed {
+		err = staging.Swap(published)
+		if err != nil {
+			LogWarn("can not swap staged database into " + RepoDir(db) + ": " + err.Error())
+			for _, req := range batch {
+				if req.err == nil {
+					req.err = err
+				}
+			}
+		} else {
+			after, err := ReadRepoDB(db)
+			if err != nil {
+				LogWarn("can not read database to remove replaced archives: " + err.Error())
+			} else {
+				PruneReplaced(db, before, after, repo.Keep)
+			}
+		}
+	}
+	for _, req := range batch {
+		if req.err != nil {
+			LogWarn("can not publish package " + req.Pkg.ID() + ", see \"" + PublishLogFile() + "\": " + req.err.Error())
+			req.result <- req.err
+			continue
+		}
+		if len(req.Remove) > 0 {
+			LogInfo(strings.Join(req.Remove, ", ") + " of package " + req.Pkg.ID() + " removed from " + db)
+		} else {
+			LogInfo("package " + req.Pkg.ID() + " published to " + db)
+		}
+		req.result <- nil
+	}
+}
+
+// Sign every archive in the database again with the active keys of its
+// repo, add them again so the signatures embedded in the database are
+// updated, then sign the database. Everything goes through the staging dir
+// like a normal batch.
+func ResignRepo(db string) error {
+	repo := RepoOf(db)
+	if len(repo.SignKeys) == 0 {
+		return errors.New("no key specified for repo " + repo.Name)
+	}
+	dbLock, err := Lock(db + SUFFIX_DB_LOCK)
+	if err != nil {
+		return err
+	}
+	defer Unlock(dbLock)
+	entries, err := ReadRepoDB(db)
+	if err != nil {
+		return err
+	}
+	staging, err := NewStaging(db)
+	if err != nil {
+		return err
+	}
+	defer staging.Cleanup()
+	archives := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		archive := path.Join(RepoDir(db), entry.Filename)
+		if !FileExists(archive) {
+			LogWarn("archive \"" + entry.Filename + "\" in database is missing, skipped")
+			continue
+		}
+		err := LinkOrCopy(path.Join(staging.Dir, entry.Filename), archive)
+		if err != nil {
+			return err
+		}
+		err = SignFile(path.Join(staging.Dir, entry.Filename), repo.SignKeys, PublishLogFile())
+		if err != nil {
+			return err
+		}
+		archives = append(archives, path.Join(staging.Dir, entry.Filename))
+	}
+	if len(archives) == 0 {
+		return nil
+	}
+	LogInfo("re-signed " + strconv.Itoa(len(archives)) + " archive(s), updating " + db)
+	err = repoAdd(staging.DBPath(), archives)
+	if err != nil {
+		return err
+	}
+	err = SignStagedDB(staging)
+	if err != nil {
+		return err
+	}
+	return staging.Swap(archives)
+}
@@ -0,0 +1,219 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:14:24
+ * @LastEditTime: 2026-10-19 14:52:24
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/queue.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FILE_QUEUE string = "queue.json"
+
+const (
+	JOB_PENDING     string = "pending"
+	JOB_RUNNING     string = "running"
+	JOB_INTERRUPTED string = "interrupted"
+)
+
+type Job struct {
+	ID       int64     `json:"id"`
+	Package  string    `json:"package"`
+	State    string    `json:"state"`
+	Enqueued time.Time `json:"enqueued"`
+	Started  time.Time `json:"started,omitzero"`
+}
+
+type JobQueue struct {
+	lock   sync.Mutex
+	NextID int64 `json:"next_id"`
+	Jobs   []Job `json:"jobs"`
+}
+
+var Queue JobQueue
+
+func QueueFile() string {
+	return path.Join(Conf.WorkingDir, FILE_QUEUE)
+}
+
+// Write the queue to a temp file and rename it, so a crash never leaves
+// a half-written queue behind. Caller must hold the lock.
+func (q *JobQueue) save() error {
+	data, err := json.MarshalIndent(q, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := QueueFile() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, QueueFile())
+}
+
+func (q *JobQueue) saveOrWarn() {
+	err := q.save()
+	if err != nil {
+		LogWarn("can not save job queue: " + err.Error())
+	}
+}
+
+func (q *JobQueue) Load() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.Jobs = make([]Job, 0)
+	data, err := os.ReadFile(QueueFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, q)
+}
+
+// Add a pending job for the package, unless it is already queued or running.
+func (q *JobQueue) Enqueue(pkgName string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, job := range q.Jobs {
+		if job.Package == pkgName {
+			return false
+		}
+	}
+	q.NextID++
+	q.Jobs = append(q.Jobs, Job{ID: q.NextID, Package: pkgName, State: JOB_PENDING, Enqueued: time.Now()})
+	q.saveOrWarn()
+	return true
+}
+
+// Jobs which are waiting to be dispatched, in queue order.
+func (q *JobQueue) Waiting() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	res := make([]Job, 0)
+	for _, job := range q.Jobs {
+		if job.State == JOB_PENDING || job.State == JOB_INTERRUPTED {
+			res = append(res, job)
+		}
+	}
+	return res
+}
+
+// Mark the job as running, returns false if it is no longer waiting.
+func (q *JobQueue) Start(id int64) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := range q.Jobs {
+		if q.Jobs[i].ID != id {
+			continue
+		}
+		if q.Jobs[i].State == JOB_RUNNING {
+			return false
+		}
+		q.Jobs[i].State = JOB_RUNNING
+		q.Jobs[i].Started = time.Now()
+		q.saveOrWarn()
+		return true
+	}
+	return false
+}
+
+// Put a running job back to pending, it will be dispatched again.
+func (q *JobQueue) Requeue(id int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := range q.Jobs {
+		if q.Jobs[i].ID == id {
+			q.Jobs[i].State = JOB_PENDING
+			q.Jobs[i].Started = time.Time{}
+			q.saveOrWarn()
+			return
+		}
+	}
+}
+
+// Drop the job from the queue, no matter it succeeded or not.
+func (q *JobQueue) Finish(id int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := range q.Jobs {
+		if q.Jobs[i].ID == id {
+			q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+			q.saveOrWarn()
+			return
+		}
+	}
+}
+
+// Jobs still marked as running were killed with the last process, mark them
+// as interrupted and clean what they left, they will be dispatched first.
+func (q *JobQueue) Recover() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	kept := make([]Job, 0, len(q.Jobs))
+	for _, job := range q.Jobs {
+		pkg := PkgByID(job.Package)
+		if pkg == nil {
+			LogWarn("dropped queued job of package " + job.Package + ": no longer in config")
+			continue
+		}
+		if job.State == JOB_RUNNING {
+			LogWarn("job #" + strconv.FormatInt(job.ID, 10) + " of package " + job.Package + " was interrupted, will clean and rebuild it")
+			job.State = JOB_INTERRUPTED
+			lockFile, err := TryLock(PkgLockFile(pkg))
+			if err != nil {
+				LogWarn("will not clean partial build of package " + job.Package + ": " + err.Error())
+				kept = append(kept, job)
+				continue
+			}
+			err = CleanPartialBuild(pkg)
+			Unlock(lockFile)
+			if err != nil {
+				LogWarn("can not clean partial build of package " + job.Package + ": " + err.Error())
+			}
+		}
+		kept = append(kept, job)
+	}
+	q.Jobs = kept
+	q.saveOrWarn()
+	if len(q.Jobs) > 0 {
+		LogInfo(strconv.Itoa(len(q.Jobs)) + " unfinished job(s) recovered from the job queue")
+	}
+}
+
+// Remove the artifacts of an unfinished build and the build-ok flag, so the
+// skip logic will not treat the package as built.
+func CleanPartialBuild(pkg *Package) error {
+	entries, err := os.ReadDir(PkgBuildingDir(pkg))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), SUFFIX_PKG) || strings.HasSuffix(e.Name(), SUFFIX_SIG) || e.Name() == FLG_FILE_NO_ERR_BEFORE {
+			err := os.Remove(path.Join(PkgBuildingDir(pkg), e.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
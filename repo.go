@@ -0,0 +1,192 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:40:30
+ * @LastEditTime: 2026-10-19 15:05:31
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/repo.go
+ */
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/FunctionSir/readini"
+)
+
+const (
+	SEC_REPO_PREFIX string = "repo:"
+	REPO_DEFAULT    string = "default"
+)
+
+// A target repository. The one of [GENERAL] is named "default", its
+// databases for variants come from the variant sections.
+type Repo struct {
+	Name       string
+	TargetDB   string
+	VariantDBs map[string]string
+	SignKeys   []string
+	Keep       int
+	PromoteTo  string
+	SoakTime   time.Duration
+}
+
+func IsRepoSection(name string) bool {
+	return strings.HasPrefix(name, SEC_REPO_PREFIX)
+}
+
+// The database of the repo for the variant, empty if it has none.
+func (r *Repo) DB(variant string) string {
+	if variant == "" {
+		return r.TargetDB
+	}
+	return r.VariantDBs[variant]
+}
+
+func (r *Repo) DBs() []string {
+	res := []string{r.TargetDB}
+	for _, name := range VariantNames() {
+		if db, ok := r.VariantDBs[name]; ok {
+			res = append(res, db)
+		}
+	}
+	return res
+}
+
+// The default repo first, then the repo sections by name. Signing keys and
+// retention not set in a section are taken from [GENERAL].
+func readRepos(conf readini.Conf) []Repo {
+	def := Repo{Name: REPO_DEFAULT, TargetDB: Conf.TargetDB, VariantDBs: make(map[string]string), SignKeys: Conf.SignKeys, Keep: Conf.Keep}
+	for _, v := range Conf.VariantDefs {
+		def.VariantDBs[v.Name] = v.TargetDB
+	}
+	sections := make([]Repo, 0)
+	for secName, sec := range conf {
+		if !IsRepoSection(secName) {
+			continue
+		}
+		r := Repo{Name: strings.TrimPrefix(secName, SEC_REPO_PREFIX), VariantDBs: make(map[string]string), SignKeys: Conf.SignKeys, Keep: Conf.Keep}
+		if r.Name == "" || r.Name == REPO_DEFAULT {
+			LogError("invalid repo name in section \"" + secName + "\"")
+		}
+		chkKey(sec, secName, KEY_TARGET_DB)
+		chkTargetDB(sec[KEY_TARGET_DB])
+		r.TargetDB = sec[KEY_TARGET_DB]
+		for key, val := range sec {
+			variant, found := strings.CutPrefix(key, KEY_TARGET_DB+VARIANT_SEP)
+			if !found {
+				continue
+			}
+			if !slices.Contains(VariantNames(), variant) {
+				LogError("variant \"" + variant + "\" in section \"" + secName + "\" is not defined")
+			}
+			chkTargetDB(val)
+			r.VariantDBs[variant] = val
+		}
+		if sec.HasKey(KEY_KEY) {
+			r.SignKeys = ConfValToSignKeys(sec[KEY_KEY])
+		}
+		if sec.HasKey(KEY_KEEP) {
+			r.Keep = ConfValToInt(sec[KEY_KEEP])
+		}
+		if sec.HasKey(KEY_PROMOTE_TO) {
+			r.PromoteTo = sec[KEY_PROMOTE_TO]
+		}
+		if sec.HasKey(KEY_SOAK_TIME) {
+			r.SoakTime = ConfValToDuration(sec[KEY_SOAK_TIME])
+			if r.PromoteTo == "" {
+				LogError("\"" + KEY_SOAK_TIME + "\" in section \"" + secName + "\" needs \"" + KEY_PROMOTE_TO + "\"")
+			}
+		}
+		sections = append(sections, r)
+	}
+	slices.SortFunc(sections, func(a Repo, b Repo) int { return strings.Compare(a.Name, b.Name) })
+	res := append([]Repo{def}, sections...)
+	// Signatures and old archives live next to the database, so repos can not
+	// share a dir.
+	seen := make([]string, 0)
+	dirs := make(map[string]string)
+	for _, r := range res {
+		for _, db := range r.DBs() {
+			if slices.Contains(seen, db) {
+				LogError("database \"" + db + "\" is used by more than one repo or variant")
+			}
+			seen = append(seen, db)
+			if owner, ok := dirs[RepoDir(db)]; ok && owner != r.Name {
+				LogError("repo " + r.Name + " and " + owner + " can not share dir \"" + RepoDir(db) + "\"")
+			}
+			dirs[RepoDir(db)] = r.Name
+		}
+		if r.PromoteTo != "" && (r.PromoteTo == r.Name || !slices.ContainsFunc(res, func(to Repo) bool { return to.Name == r.PromoteTo })) {
+			LogError("repo " + r.Name + " can not be promoted to \"" + r.PromoteTo + "\"")
+		}
+	}
+	return res
+}
+
+func RepoByName(name string) *Repo {
+	for i := range Conf.Repos {
+		if Conf.Repos[i].Name == name {
+			return &Conf.Repos[i]
+		}
+	}
+	return nil
+}
+
+// The repo the database belongs to.
+func RepoOf(db string) *Repo {
+	for i := range Conf.Repos {
+		if slices.Contains(Conf.Repos[i].DBs(), db) {
+			return &Conf.Repos[i]
+		}
+	}
+	return nil
+}
+
+func ConfValToRepos(val string) []string {
+	res := ConfValToList(val)
+	if len(res) == 0 {
+		LogError("\"" + KEY_REPO + "\" can not be empty")
+	}
+	for _, name := range res {
+		if RepoByName(name) == nil {
+			LogError("repo \"" + name + "\" is not defined")
+		}
+	}
+	return res
+}
+
+// Databases the package may be in: the ones it is published to, and the
+// ones it is promoted to from them.
+func PkgDBs(pkg *Package) []string {
+	res := slices.Clone(pkg.TargetDBs)
+	for i := 0; i < len(res); i++ {
+		r := RepoOf(res[i])
+		if r == nil || r.PromoteTo == "" {
+			continue
+		}
+		db := RepoByName(r.PromoteTo).DB(pkg.Variant)
+		if db != "" && !slices.Contains(res, db) {
+			res = append(res, db)
+		}
+	}
+	return res
+}
+
+// Databases the package is published to, every repo it is in must have one
+// for its variant.
+func pkgTargetDBs(pkg *Package) []string {
+	res := make([]string, 0, len(pkg.Repos))
+	for _, name := range pkg.Repos {
+		db := RepoByName(name).DB(pkg.Variant)
+		if db == "" {
+			LogError("repo \"" + name + "\" has no \"" + KEY_TARGET_DB + VARIANT_SEP + pkg.Variant + "\" for package " + pkg.ID())
+		}
+		res = append(res, db)
+	}
+	return res
+}
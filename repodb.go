@@ -0,0 +1,99 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:16:07
+ * @LastEditTime: 2026-10-19 14:16:34
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/repodb.go
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+type RepoDBEntry struct {
+	Name     string
+	Base     string
+	Version  string
+	Filename string
+	Arch     string
+}
+
+// Read the "desc" files of a .db.tar.gz created by repo-add, returns the
+// entries indexed by package name. A missing database is an empty one.
+func ReadRepoDB(db string) (map[string]RepoDBEntry, error) {
+	res := make(map[string]RepoDBEntry)
+	file, err := os.Open(db)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err == io.EOF {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "desc" {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entry := parseDesc(string(content))
+		res[entry.Name] = entry
+	}
+	return res, nil
+}
+
+func parseDesc(desc string) RepoDBEntry {
+	var entry RepoDBEntry
+	key := ""
+	for _, line := range strings.Split(desc, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			key = ""
+			continue
+		}
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			key = line
+			continue
+		}
+		switch key {
+		case "%NAME%":
+			entry.Name = line
+		case "%BASE%":
+			entry.Base = line
+		case "%VERSION%":
+			entry.Version = line
+		case "%FILENAME%":
+			entry.Filename = line
+		case "%ARCH%":
+			entry.Arch = line
+		}
+	}
+	return entry
+}
@@ -0,0 +1,240 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:17:53
+ * @LastEditTime: 2026-10-19 15:04:07
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/review.go
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const DIR_REVIEWS string = "reviews"
+
+const (
+	FILE_APPROVED string = "approved"
+	FILE_PENDING  string = "pending"
+	FILE_REJECTED string = "rejected"
+	FILE_FINDINGS string = "findings.json"
+)
+
+var (
+	pkgNameLocksLock sync.Mutex
+	pkgNameLocks     = make(map[string]*sync.Mutex)
+)
+
+var ErrAwaitingReview = errors.New("PKGBUILD awaiting review, run \"repo-donkey <config> approve <pkg>\" to build it")
+
+// Variants of a package share its review and PGP keys, so while one of them
+// handles those, the others built in parallel wait for it.
+func lockPkgName(name string) *sync.Mutex {
+	pkgNameLocksLock.Lock()
+	defer pkgNameLocksLock.Unlock()
+	lock, ok := pkgNameLocks[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		pkgNameLocks[name] = lock
+	}
+	lock.Lock()
+	return lock
+}
+
+func ReviewsDir() string {
+	return path.Join(Conf.WorkingDir, DIR_REVIEWS)
+}
+
+func PkgReviewDir(pkgName string) string {
+	return path.Join(ReviewsDir(), pkgName)
+}
+
+func reviewFile(pkgName string, name string) string {
+	return path.Join(PkgReviewDir(pkgName), name)
+}
+
+func readRevision(pkgName string, name string) ([]byte, bool) {
+	content, err := os.ReadFile(reviewFile(pkgName, name))
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+func writeRevision(pkgName string, name string, content []byte) error {
+	err := os.MkdirAll(PkgReviewDir(pkgName), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reviewFile(pkgName, name), content, 0644)
+}
+
+func removeRevision(pkgName string, name string) {
+	err := os.Remove(reviewFile(pkgName, name))
+	if err != nil && !os.IsNotExist(err) {
+		LogWarn("can not remove " + name + " revision of package " + pkgName + ": " + err.Error())
+	}
+}
+
+// Unified diff from the approved revision to the pending one.
+func PendingDiff(pkgName string) (string, error) {
+	approved := reviewFile(pkgName, FILE_APPROVED)
+	if !FileExists(approved) {
+		approved = os.DevNull
+	}
+	cmd := ExtCmd{Argv: []string{BIN_DIFF, "-u", "--label", "approved", "--label", "pending", approved, reviewFile(pkgName, FILE_PENDING)}}
+	out, err := cmd.Output("")
+	// Exit status 1 only means the files differ.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	return string(out), err
+}
+
+func PendingReviews() []string {
+	res := make([]string, 0)
+	for _, pkg := range Conf.Packages {
+		if !slices.Contains(res, pkg.Name) && FileExists(reviewFile(pkg.Name, FILE_PENDING)) {
+			res = append(res, pkg.Name)
+		}
+	}
+	return res
+}
+
+func acceptRevision(pkgName string, content []byte) error {
+	err := writeRevision(pkgName, FILE_APPROVED, content)
+	if err != nil {
+		return err
+	}
+	removeRevision(pkgName, FILE_PENDING)
+	removeRevision(pkgName, FILE_FINDINGS)
+	return nil
+}
+
+// Findings of the risk scanner for the pending revision.
+func PendingFindings(pkgName string) []Finding {
+	res := make([]Finding, 0)
+	content, hasFindings := readRevision(pkgName, FILE_FINDINGS)
+	if hasFindings {
+		json.Unmarshal(content, &res)
+	}
+	return res
+}
+
+// Decide which PKGBUILD to build. A fetched revision which differs from the
+// approved one is scanned for risky changes, then it is either accepted, or
+// kept as pending if review mode is on or the findings should block it, and
+// the approved one is built until someone approves it.
+func ReviewPkgbuild(pkg *Package, fetched []byte, rec *BuildRecord) ([]byte, error) {
+	defer lockPkgName(pkg.Name).Unlock()
+	approved, hasApproved := readRevision(pkg.Name, FILE_APPROVED)
+	if !hasApproved && FileExists(PkgPkgbuild(pkg)) {
+		// The PKGBUILD built before.
+		current, err := os.ReadFile(PkgPkgbuild(pkg))
+		if err != nil {
+			return nil, err
+		}
+		err = writeRevision(pkg.Name, FILE_APPROVED, current)
+		if err != nil {
+			return nil, err
+		}
+		LogInfo("the current PKGBUILD of package " + pkg.Name + " is taken as the approved revision")
+		approved, hasApproved = current, true
+	}
+	if hasApproved && bytes.Equal(approved, fetched) {
+		removeRevision(pkg.Name, FILE_PENDING)
+		removeRevision(pkg.Name, FILE_FINDINGS)
+		return approved, nil
+	}
+	// A brand new package is not a change, there is nothing to compare with.
+	findings := make([]Finding, 0)
+	if hasApproved {
+		findings = ScanChange(approved, fetched)
+	}
+	rec.Findings = findings
+	blocked := pkg.BlockOnRisk && len(findings) > 0
+	if !pkg.Review && !blocked {
+		logFindings(pkg.Name, findings)
+		return fetched, acceptRevision(pkg.Name, fetched)
+	}
+	if ok, reason := AutoApprove(pkg, approved, hasApproved, fetched); ok && !blocked {
+		logFindings(pkg.Name, findings)
+		LogInfo("new PKGBUILD revision of package " + pkg.Name + " approved automatically: " + reason)
+		return fetched, acceptRevision(pkg.Name, fetched)
+	}
+	rejected, hasRejected := readRevision(pkg.Name, FILE_REJECTED)
+	pending, hasPending := readRevision(pkg.Name, FILE_PENDING)
+	if !(hasRejected && bytes.Equal(rejected, fetched)) && !(hasPending && bytes.Equal(pending, fetched)) {
+		err := writeRevision(pkg.Name, FILE_PENDING, fetched)
+		if err != nil {
+			return nil, err
+		}
+		content, err := json.Marshal(findings)
+		if err == nil {
+			err = writeRevision(pkg.Name, FILE_FINDINGS, content)
+		}
+		if err != nil {
+			LogWarn("can not save findings of package " + pkg.Name + ": " + err.Error())
+		}
+		diff, err := PendingDiff(pkg.Name)
+		if err != nil {
+			LogWarn("can not diff pending PKGBUILD of package " + pkg.Name + ": " + err.Error())
+		}
+		logFindings(pkg.Name, findings)
+		LogWarn("new PKGBUILD revision of package " + pkg.Name + " awaits review:\n" + diff)
+	}
+	if !hasApproved {
+		return nil, ErrAwaitingReview
+	}
+	if blocked {
+		LogWarn("new PKGBUILD revision of package " + pkg.Name + " is blocked by " + strconv.Itoa(len(findings)) + " risk finding(s), building the approved revision")
+	}
+	return approved, nil
+}
+
+func logFindings(pkgName string, findings []Finding) {
+	for _, f := range findings {
+		LogWarn("risky change in PKGBUILD of package " + pkgName + ": " + f.String())
+	}
+}
+
+func ApproveRevision(pkgName string) error {
+	pending, hasPending := readRevision(pkgName, FILE_PENDING)
+	if !hasPending {
+		return errors.New("no pending PKGBUILD revision of package " + pkgName)
+	}
+	err := acceptRevision(pkgName, pending)
+	if err != nil {
+		return err
+	}
+	removeRevision(pkgName, FILE_REJECTED)
+	return nil
+}
+
+// The rejected revision is remembered, so it will not show up again as
+// pending until upstream changes again.
+func RejectRevision(pkgName string) error {
+	pending, hasPending := readRevision(pkgName, FILE_PENDING)
+	if !hasPending {
+		return errors.New("no pending PKGBUILD revision of package " + pkgName)
+	}
+	err := writeRevision(pkgName, FILE_REJECTED, pending)
+	if err != nil {
+		return err
+	}
+	removeRevision(pkgName, FILE_PENDING)
+	removeRevision(pkgName, FILE_FINDINGS)
+	return nil
+}
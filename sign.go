@@ -0,0 +1,206 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:23:45
+ * @LastEditTime: 2026-10-19 14:43:54
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/sign.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DIR_GNUPG string = "gnupg"
+
+const LOG_FILE_SIGN string = "sign.log"
+
+func SignHome() string {
+	return path.Join(Conf.WorkingDir, DIR_GNUPG)
+}
+
+func SignLogFile() string {
+	return path.Join(LogsDir(), LOG_FILE_SIGN)
+}
+
+// Whether any repo is signed.
+func SigningEnabled() bool {
+	return slices.ContainsFunc(Conf.Repos, func(r Repo) bool { return len(r.SignKeys) > 0 })
+}
+
+// The first key is the current one. During a rotation, everything is signed
+// by all keys, so clients which only know the old key keep working.
+func ActiveSignKeys(keys []string) []string {
+	if Conf.KeyRotation {
+		return keys
+	}
+	return keys[:1]
+}
+
+// Options every gpg call for signing needs. With a key file, a dedicated
+// homedir is used, with a passphrase file, no agent or pinentry is needed.
+func gpgArgs() []string {
+	args := []string{"--batch"}
+	if Conf.SignKeyFile != "" {
+		args = append(args, "--homedir", SignHome())
+	}
+	if Conf.PassphraseFile != "" {
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-file", Conf.PassphraseFile)
+	}
+	return args
+}
+
+// Import the key file into the dedicated homedir.
+func InitSigning() {
+	if !SigningEnabled() || Conf.SignKeyFile == "" {
+		return
+	}
+	Check(os.MkdirAll(SignHome(), 0700))
+	Check(ChownToBuildUser(SignHome()))
+	Check(SudoRun(Conf.BuildUser, Conf.BuildGroup, SignLogFile(), BIN_GPG, append(gpgArgs(), "--import", Conf.SignKeyFile)...))
+}
+
+// Detach-sign the file with every active key, gpg concatenates the
+// signatures into one file, then check they really verify.
+func SignFile(file string, keys []string, logFile string) error {
+	args := append(gpgArgs(), "--detach-sign", "--yes", "--output", file+".sig")
+	for _, key := range ActiveSignKeys(keys) {
+		if key != SIGN_USE_DEFAULT {
+			args = append(args, "--local-user", key)
+		}
+	}
+	args = append(args, file)
+	err := SudoRun(Conf.BuildUser, Conf.BuildGroup, logFile, BIN_GPG, args...)
+	if err != nil {
+		return errors.New("can not sign \"" + path.Base(file) + "\": " + err.Error())
+	}
+	return VerifySig(file, keys, logFile)
+}
+
+func VerifySig(file string, keys []string, logFile string) error {
+	args := append(gpgArgs(), "--status-fd", "1", "--verify", file+".sig", file)
+	out, err := SudoOutput(Conf.BuildUser, Conf.BuildGroup, path.Dir(file), logFile, BIN_GPG, args...)
+	if err != nil {
+		return errors.New("signature of \"" + path.Base(file) + "\" does not verify: " + err.Error())
+	}
+	valid := strings.Count(string(out), "[GNUPG:] VALIDSIG ")
+	if valid < len(ActiveSignKeys(keys)) {
+		return errors.New("signature of \"" + path.Base(file) + "\" has " + strconv.Itoa(valid) + " valid signature(s), " + strconv.Itoa(len(ActiveSignKeys(keys))) + " expected")
+	}
+	return nil
+}
+
+// Parse "gpg --with-colons --list-secret-keys", returns whether the key can
+// sign, and when the last signing capable (sub)key expires, zero for never.
+func parseSecretKeys(out string) (bool, time.Time) {
+	usable := false
+	var expiry time.Time
+	never := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 12 || (fields[0] != "sec" && fields[0] != "ssb") {
+			continue
+		}
+		validity, caps := fields[1], fields[11]
+		if fields[0] == "sec" && strings.Contains(caps, "S") {
+			usable = true
+		}
+		if !strings.Contains(caps, "s") || validity == "e" || validity == "r" || validity == "i" {
+			continue
+		}
+		if fields[6] == "" {
+			never = true
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[6], 10, 64)
+		if err == nil && time.Unix(sec, 0).After(expiry) {
+			expiry = time.Unix(sec, 0)
+		}
+	}
+	if never {
+		expiry = time.Time{}
+	}
+	return usable, expiry
+}
+
+// Check before a round that the active keys of every repo exist, are not
+// expired and can sign without interaction, warn if one expires soon.
+func CheckSignKey() error {
+	for _, r := range Conf.Repos {
+		if len(r.SignKeys) == 0 {
+			continue
+		}
+		err := checkSignKeys(r.SignKeys)
+		if err != nil {
+			return errors.New("repo " + r.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func checkSignKeys(keys []string) error {
+	for _, key := range ActiveSignKeys(keys) {
+		args := append(gpgArgs(), "--with-colons", "--list-secret-keys")
+		if key != SIGN_USE_DEFAULT {
+			args = append(args, key)
+		}
+		out, err := SudoOutput(Conf.BuildUser, Conf.BuildGroup, Conf.WorkingDir, SignLogFile(), BIN_GPG, args...)
+		if err != nil {
+			return errors.New("can not find secret key " + key + ": " + err.Error())
+		}
+		usable, expiry := parseSecretKeys(string(out))
+		if !usable {
+			return errors.New("secret key " + key + " is expired, revoked or can not sign")
+		}
+		if !expiry.IsZero() && time.Until(expiry) < Conf.KeyExpiryWarn {
+			LogWarn("signing key " + key + " expires on " + expiry.Format(time.DateTime) + ", please renew it")
+		}
+	}
+	testDir, err := os.MkdirTemp(Conf.WorkingDir, "sign-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(testDir)
+	err = ChownToBuildUser(testDir)
+	if err != nil {
+		return err
+	}
+	testFile := path.Join(testDir, "test")
+	err = os.WriteFile(testFile, []byte("repo-donkey signing test\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return SignFile(testFile, keys, SignLogFile())
+}
+
+// Sign the database and files database in the staging dir, and create the
+// symlinks repo-add would create.
+func SignStagedDB(s *Staging) error {
+	base := DBBaseName(s.DB)
+	for _, pair := range [][2]string{{base + SUFFIX_DB, base + ".db"}, {base + SUFFIX_FILES_DB, base + ".files"}} {
+		file := path.Join(s.Dir, pair[0])
+		if !FileExists(file) {
+			continue
+		}
+		err := SignFile(file, RepoOf(s.DB).SignKeys, PublishLogFile())
+		if err != nil {
+			return err
+		}
+		link := path.Join(s.Dir, pair[1]+".sig")
+		os.Remove(link)
+		err = os.Symlink(pair[0]+".sig", link)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:31:39
+ * @LastEditTime: 2026-10-19 15:13:34
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/snapshot.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	SNAPSHOT_AUTO    string = "auto"
+	SNAPSHOT_BTRFS   string = "btrfs"
+	SNAPSHOT_OVERLAY string = "overlay"
+	SNAPSHOT_COPY    string = "copy"
+)
+
+const (
+	BIN_BTRFS  string = "/usr/bin/btrfs"
+	BIN_MOUNT  string = "/usr/bin/mount"
+	BIN_UMOUNT string = "/usr/bin/umount"
+)
+
+const (
+	SNAPSHOT_PREFIX  string = "snap-"
+	SUFFIX_OVERLAY   string = ".overlay"
+	BTRFS_MAGIC      int64  = 0x9123683E
+	BTRFS_SUBVOL_INO uint64 = 256
+)
+
+func ConfValToSnapshotMode(val string) string {
+	if val != SNAPSHOT_AUTO && val != SNAPSHOT_BTRFS && val != SNAPSHOT_OVERLAY && val != SNAPSHOT_COPY {
+		LogError("invalid value \"" + val + "\" for key \"" + KEY_SNAPSHOT + "\"")
+	}
+	if val != SNAPSHOT_AUTO && val != SNAPSHOT_COPY && Rootless() {
+		LogError("\"" + KEY_SNAPSHOT + "\" can only be \"" + SNAPSHOT_AUTO + "\" or \"" + SNAPSHOT_COPY + "\" when not running as root")
+	}
+	return val
+}
+
+func IsBtrfs(dir string) bool {
+	var stat syscall.Statfs_t
+	return syscall.Statfs(dir, &stat) == nil && int64(stat.Type) == BTRFS_MAGIC
+}
+
+// The top dir of a btrfs subvolume always has inode 256.
+func IsSubvolume(dir string) bool {
+	var stat syscall.Stat_t
+	return IsBtrfs(dir) && syscall.Stat(dir, &stat) == nil && stat.Ino == BTRFS_SUBVOL_INO
+}
+
+func isMountPoint(dir string) bool {
+	var stat, parent syscall.Stat_t
+	if syscall.Stat(dir, &stat) != nil || syscall.Stat(path.Dir(dir), &parent) != nil {
+		return false
+	}
+	return stat.Dev != parent.Dev
+}
+
+// How the chroot of a build is made from the master. Snapshots need root,
+// without it makechrootpkg copies the master by itself, which is also a
+// snapshot on btrfs but is kept until the next build of the worker.
+func SnapshotMode(key string) string {
+	subvolume := IsSubvolume(MasterRoot(key))
+	mode := chooseSnapshotMode(Conf.ChrootSnapshot, Rootless(), subvolume)
+	if Conf.ChrootSnapshot == SNAPSHOT_BTRFS && !subvolume {
+		LogWarn("master chroot \"" + key + "\" is not a btrfs subvolume, will use overlayfs instead")
+	}
+	return mode
+}
+
+// btrfs snapshots when the master is a subvolume, overlayfs otherwise.
+func chooseSnapshotMode(mode string, rootless bool, subvolume bool) string {
+	switch {
+	case rootless:
+		return SNAPSHOT_COPY
+	case mode == SNAPSHOT_AUTO && subvolume:
+		return SNAPSHOT_BTRFS
+	case mode == SNAPSHOT_AUTO || (mode == SNAPSHOT_BTRFS && !subvolume):
+		return SNAPSHOT_OVERLAY
+	}
+	return mode
+}
+
+// A throwaway chroot for one build, makechrootpkg uses it as the copy named
+// Name in the master dir.
+type Snapshot struct {
+	Key  string
+	Name string
+	Mode string
+	// Held while an overlay is mounted on the master.
+	locks []*os.File
+}
+
+func (s *Snapshot) Dir() string {
+	return path.Join(MasterDir(s.Key), s.Name)
+}
+
+func (s *Snapshot) overlayDir() string {
+	return s.Dir() + SUFFIX_OVERLAY
+}
+
+// The master must not change while it is snapshotted. A btrfs snapshot is
+// independent of it once taken, so root.lock is released at once. The lower
+// dir of an overlay must not change while it is mounted, so the chroot lock
+// and root.lock are held shared until the snapshot is removed, updates of
+// the master skip it or wait meanwhile.
+func NewSnapshot(key string, worker int, logFile string) (*Snapshot, error) {
+	snap := &Snapshot{Key: key, Name: SNAPSHOT_PREFIX + WorkerCopy(worker), Mode: SnapshotMode(key)}
+	err := removeSnapshot(MasterDir(key), snap.Name, logFile)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Mode == SNAPSHOT_OVERLAY {
+		chrootLock, err := LockShared(ChrootLockFile(key))
+		if err != nil {
+			return nil, err
+		}
+		snap.locks = append(snap.locks, chrootLock)
+	}
+	rootLock, err := LockShared(path.Join(MasterDir(key), FILE_ROOT_LOCK))
+	if err != nil {
+		snap.unlock()
+		return nil, err
+	}
+	snap.locks = append(snap.locks, rootLock)
+	switch snap.Mode {
+	case SNAPSHOT_BTRFS:
+		snapCmd := ExtCmd{Argv: []string{BIN_BTRFS, "subvolume", "snapshot", MasterRoot(key), snap.Dir()}}
+		err = snapCmd.Run(logFile)
+		snap.unlock()
+	case SNAPSHOT_OVERLAY:
+		err = snap.mountOverlay(logFile)
+	}
+	if err != nil {
+		snap.Remove(logFile)
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *Snapshot) mountOverlay(logFile string) error {
+	upper := path.Join(s.overlayDir(), "upper")
+	work := path.Join(s.overlayDir(), "work")
+	for _, dir := range []string{upper, work, s.Dir()} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	opts := "lowerdir=" + MasterRoot(s.Key) + ",upperdir=" + upper + ",workdir=" + work
+	mountCmd := ExtCmd{Argv: []string{BIN_MOUNT, "-t", "overlay", "overlay", "-o", opts, s.Dir()}}
+	return mountCmd.Run(logFile)
+}
+
+func (s *Snapshot) unlock() {
+	for i := len(s.locks) - 1; i >= 0; i-- {
+		Unlock(s.locks[i])
+	}
+	s.locks = nil
+}
+
+// The locks are released only after the overlay is unmounted.
+func (s *Snapshot) Remove(logFile string) {
+	err := removeSnapshot(MasterDir(s.Key), s.Name, logFile)
+	if err != nil {
+		LogWarn("can not remove chroot snapshot " + s.Dir() + ": " + err.Error())
+	}
+	s.unlock()
+}
+
+// Remove a snapshot and everything which belongs to it, whatever state it
+// was left in, including overlays mounted by older versions.
+func removeSnapshot(masterDir string, name string, logFile string) error {
+	dir := path.Join(masterDir, name)
+	if isMountPoint(dir) {
+		umountCmd := ExtCmd{Argv: []string{BIN_UMOUNT, dir}}
+		err := umountCmd.Run(logFile)
+		if err != nil {
+			return err
+		}
+	}
+	if IsSubvolume(dir) {
+		deleteCmd := ExtCmd{Argv: []string{BIN_BTRFS, "subvolume", "delete", dir}}
+		err := deleteCmd.Run(logFile)
+		if err != nil {
+			return err
+		}
+	}
+	// makechrootpkg also leaves a lock file next to the copy.
+	for _, leftover := range []string{dir, dir + SUFFIX_OVERLAY, dir + ".lock"} {
+		err := os.RemoveAll(leftover)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove all snapshots of the master, returns how many were removed.
+func cleanMasterSnapshots(key string) int {
+	entries, err := os.ReadDir(MasterDir(key))
+	if err != nil {
+		return 0
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), SUFFIX_OVERLAY)
+		if e.IsDir() && strings.HasPrefix(name, SNAPSHOT_PREFIX) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	cnt := 0
+	for _, name := range names {
+		err := removeSnapshot(MasterDir(key), name, "")
+		if err != nil {
+			LogWarn("can not remove leftover chroot snapshot " + name + " of master chroot \"" + key + "\": " + err.Error())
+			continue
+		}
+		cnt++
+	}
+	return cnt
+}
+
+// Snapshots of builds killed with the last process are still there, remove
+// them before any new build starts.
+func CleanSnapshots() {
+	masters, err := os.ReadDir(ChrootsDir())
+	if err != nil {
+		return
+	}
+	cnt := 0
+	for _, master := range masters {
+		if master.IsDir() {
+			cnt += cleanMasterSnapshots(master.Name())
+		}
+	}
+	if cnt > 0 {
+		LogInfo(strconv.Itoa(cnt) + " leftover chroot snapshot(s) removed")
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 15:13:21
+ * @LastEditTime: 2026-10-19 15:13:34
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/snapshot_test.go
+ */
+
+package main
+
+import "testing"
+
+func TestChooseSnapshotMode(t *testing.T) {
+	cases := []struct {
+		mode      string
+		rootless  bool
+		subvolume bool
+		want      string
+	}{
+		{SNAPSHOT_AUTO, false, true, SNAPSHOT_BTRFS},
+		{SNAPSHOT_AUTO, false, false, SNAPSHOT_OVERLAY},
+		{SNAPSHOT_AUTO, true, true, SNAPSHOT_COPY},
+		{SNAPSHOT_AUTO, true, false, SNAPSHOT_COPY},
+		{SNAPSHOT_BTRFS, false, true, SNAPSHOT_BTRFS},
+		{SNAPSHOT_BTRFS, false, false, SNAPSHOT_OVERLAY},
+		{SNAPSHOT_OVERLAY, false, true, SNAPSHOT_OVERLAY},
+		{SNAPSHOT_OVERLAY, false, false, SNAPSHOT_OVERLAY},
+		{SNAPSHOT_COPY, false, true, SNAPSHOT_COPY},
+		{SNAPSHOT_COPY, true, false, SNAPSHOT_COPY},
+	}
+	for _, tc := range cases {
+		got := chooseSnapshotMode(tc.mode, tc.rootless, tc.subvolume)
+		if got != tc.want {
+			t.Errorf("mode %s, rootless %v, subvolume %v: got %s, want %s", tc.mode, tc.rootless, tc.subvolume, got, tc.want)
+		}
+	}
+}
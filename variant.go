@@ -0,0 +1,158 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:38:29
+ * @LastEditTime: 2026-10-19 15:04:59
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/variant.go
+ */
+
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/FunctionSir/readini"
+)
+
+const (
+	SEC_VARIANT_PREFIX string = "variant:"
+	VARIANT_SEP        string = "@"
+	// Stands for the build without variant in Variants.
+	VARIANT_DEFAULT string = "default"
+)
+
+// A build variant, every package is built once more for each enabled one,
+// with its own makepkg.conf, chroot and target database.
+type Variant struct {
+	Name              string
+	TargetDB          string
+	MakepkgConf       string
+	MakepkgConfAppend string
+	PacmanConf        string
+}
+
+// Identifies the package in one variant: dirs, queue and build history are
+// kept per ID, while review, AUR and keys stay per package name.
+func (pkg *Package) ID() string {
+	if pkg.Variant == "" {
+		return pkg.Name
+	}
+	return pkg.Name + VARIANT_SEP + pkg.Variant
+}
+
+// The first build of the package name, usually the one without variant,
+// which handles what its variants share.
+func (pkg *Package) IsPrimary() bool {
+	return PkgByName(pkg.Name).ID() == pkg.ID()
+}
+
+func IsVariantSection(name string) bool {
+	return strings.HasPrefix(name, SEC_VARIANT_PREFIX)
+}
+
+func chkTargetDB(db string) {
+	if !DirExists(path.Dir(db)) || !strings.HasSuffix(db, SUFFIX_DB) {
+		LogError("invalid path for target database \"" + db + "\"")
+	}
+}
+
+func readVariants(conf readini.Conf) []Variant {
+	res := make([]Variant, 0)
+	for secName, sec := range conf {
+		if !IsVariantSection(secName) {
+			continue
+		}
+		v := Variant{Name: strings.TrimPrefix(secName, SEC_VARIANT_PREFIX)}
+		if v.Name == "" || v.Name == VARIANT_DEFAULT || strings.Contains(v.Name, VARIANT_SEP) || strings.Contains(v.Name, "/") {
+			LogError("invalid variant name in section \"" + secName + "\"")
+		}
+		chkKey(sec, secName, KEY_TARGET_DB)
+		chkTargetDB(sec[KEY_TARGET_DB])
+		v.TargetDB = sec[KEY_TARGET_DB]
+		v.MakepkgConf = sec[KEY_MAKEPKG_CONF]
+		v.MakepkgConfAppend = sec[KEY_CONF_APPEND]
+		v.PacmanConf = sec[KEY_PACMAN_CONF]
+		res = append(res, v)
+	}
+	slices.SortFunc(res, func(a Variant, b Variant) int { return strings.Compare(a.Name, b.Name) })
+	return res
+}
+
+func VariantNames() []string {
+	res := make([]string, 0, len(Conf.VariantDefs))
+	for _, v := range Conf.VariantDefs {
+		res = append(res, v.Name)
+	}
+	return res
+}
+
+func ConfValToVariants(val string) []string {
+	res := ConfValToList(val)
+	for _, name := range res {
+		if name != VARIANT_DEFAULT && !slices.Contains(VariantNames(), name) {
+			LogError("variant \"" + name + "\" is not defined")
+		}
+	}
+	return res
+}
+
+// The package as built without variant, followed by a copy for each of its
+// variants, each only if listed in Variants. Snippets of the variant come
+// before the one of the package.
+func expandVariants(pkg Package) []Package {
+	res := make([]Package, 0, len(pkg.Variants))
+	for _, v := range append([]Variant{{}}, Conf.VariantDefs...) {
+		name := v.Name
+		if name == "" {
+			name = VARIANT_DEFAULT
+		}
+		if !slices.Contains(pkg.Variants, name) {
+			continue
+		}
+		cur := pkg
+		cur.Variant = v.Name
+		snippets := make([]string, 0)
+		if v.Name != "" {
+			if v.MakepkgConf != "" {
+				cur.MakepkgConf = v.MakepkgConf
+			}
+			if v.PacmanConf != "" {
+				cur.PacmanConf = v.PacmanConf
+			}
+			if v.MakepkgConfAppend != "" {
+				snippets = append(snippets, v.MakepkgConfAppend)
+			}
+		}
+		if pkg.MakepkgConfAppend != "" {
+			snippets = append(snippets, pkg.MakepkgConfAppend)
+		}
+		if len(snippets) > 0 {
+			cur.MakepkgConf = genMakepkgConf(&cur, snippets)
+		}
+		cur.TargetDBs = pkgTargetDBs(&cur)
+		res = append(res, cur)
+	}
+	return res
+}
+
+// Every database packages are published to.
+func TargetDBs() []string {
+	res := make([]string, 0)
+	for _, r := range Conf.Repos {
+		res = append(res, r.DBs()...)
+	}
+	return res
+}
+
+func PkgByID(id string) *Package {
+	for i := range Conf.Packages {
+		if Conf.Packages[i].ID() == id {
+			return &Conf.Packages[i]
+		}
+	}
+	return nil
+}
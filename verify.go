@@ -0,0 +1,150 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:17:10
+ * @LastEditTime: 2026-10-19 14:53:37
+ * @LastEditors: FunctionSir
+ * @Description: -
+ * @FilePath: /repo-donkey/verify.go
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const NAMCAP_BLOCK_ALL_ERRORS string = "E"
+
+// makepkg splits debug symbols into <pkgname>-debug with the debug option,
+// which is on by default.
+const SUFFIX_DEBUG_PKG string = "-debug"
+
+type Pkginfo struct {
+	Pkgname string
+	Pkgver  string
+	Arch    string
+}
+
+func ReadPkginfo(archive string, logFile string) (*Pkginfo, error) {
+	cmd := ExtCmd{Argv: []string{BIN_BSDTAR, "-xOf", archive, ".PKGINFO"}}
+	out, err := cmd.Output(logFile)
+	if err != nil {
+		return nil, err
+	}
+	res := &Pkginfo{}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, val, found := strings.Cut(line, "=")
+		if !found || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "pkgname":
+			res.Pkgname = strings.TrimSpace(val)
+		case "pkgver":
+			res.Pkgver = strings.TrimSpace(val)
+		case "arch":
+			res.Arch = strings.TrimSpace(val)
+		}
+	}
+	return res, nil
+}
+
+func checkPkginfo(archive string, info *Pkginfo, srcinfo *Srcinfo) error {
+	name := path.Base(archive)
+	declared := strings.TrimSuffix(info.Pkgname, SUFFIX_DEBUG_PKG)
+	if !slices.Contains(srcinfo.Pkgnames, info.Pkgname) && !slices.Contains(srcinfo.Pkgnames, declared) {
+		return errors.New(name + ": pkgname \"" + info.Pkgname + "\" is not declared in PKGBUILD")
+	}
+	if info.Pkgver != srcinfo.FullVersion() {
+		return errors.New(name + ": version \"" + info.Pkgver + "\" does not match \"" + srcinfo.FullVersion() + "\" declared in PKGBUILD")
+	}
+	if info.Arch != "any" && info.Arch != Conf.Arch {
+		return errors.New(name + ": architecture \"" + info.Arch + "\" is not \"" + Conf.Arch + "\" or \"any\"")
+	}
+	if !slices.Contains(srcinfo.Arch, info.Arch) && !slices.Contains(srcinfo.Arch, "any") {
+		return errors.New(name + ": architecture \"" + info.Arch + "\" is not declared in PKGBUILD")
+	}
+	return nil
+}
+
+// Run namcap in machine readable mode, lines look like
+// "pkgname E: tag details", returns the blocking findings.
+func runNamcap(pkg *Package, archive string, logFile string) ([]string, error) {
+	out, err := SudoOutput(Conf.BuildUser, Conf.BuildGroup, PkgBuildingDir(pkg), logFile, BIN_NAMCAP, "-m", archive)
+	if err != nil {
+		return nil, err
+	}
+	err = AppendToFile(logFile, out)
+	if err != nil {
+		return nil, err
+	}
+	blocking := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		level := strings.TrimSuffix(fields[1], ":")
+		tag := fields[2]
+		if slices.Contains(pkg.NamcapBlock, tag) || (level == NAMCAP_BLOCK_ALL_ERRORS && slices.Contains(pkg.NamcapBlock, NAMCAP_BLOCK_ALL_ERRORS)) {
+			blocking = append(blocking, strings.Join(fields[1:], " "))
+		}
+	}
+	return blocking, nil
+}
+
+// Check every archive in the building dir against what the PKGBUILD
+// declared, rejected archives are removed so they never get published.
+func VerifyPkg(pkg *Package, logFile string) error {
+	if !pkg.Verify {
+		return nil
+	}
+	srcinfo, err := GenSrcinfo(pkg, logFile)
+	if err != nil {
+		return errors.New("can not generate .SRCINFO: " + err.Error())
+	}
+	entries, err := os.ReadDir(PkgBuildingDir(pkg))
+	if err != nil {
+		return err
+	}
+	var verifyErr error
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), SUFFIX_PKG) {
+			continue
+		}
+		archive := path.Join(PkgBuildingDir(pkg), e.Name())
+		info, err := ReadPkginfo(archive, logFile)
+		if err != nil {
+			verifyErr = errors.New(e.Name() + ": can not read .PKGINFO: " + err.Error())
+			break
+		}
+		verifyErr = checkPkginfo(archive, info, srcinfo)
+		if verifyErr != nil {
+			break
+		}
+		if !pkg.Namcap {
+			continue
+		}
+		blocking, err := runNamcap(pkg, archive, logFile)
+		if err != nil {
+			verifyErr = errors.New(e.Name() + ": can not run namcap: " + err.Error())
+			break
+		}
+		if len(blocking) > 0 {
+			verifyErr = errors.New(e.Name() + ": blocked by namcap: " + strings.Join(blocking, "; "))
+			break
+		}
+	}
+	if verifyErr != nil {
+		err := CleanPartialBuild(pkg)
+		if err != nil {
+			LogWarn("can not remove rejected archives of package " + pkg.Name + ": " + err.Error())
+		}
+	}
+	return verifyErr
+}